@@ -0,0 +1,408 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+
+	Append-only file, like Redis'
+
+	Sets, purges, changes of expiration and flushes are appended to a log
+	while the bucket is locked, so the log has them in the order they were
+	applied. When the cache is created the log is replayed, skipping elements
+	that have expired meanwhile. Records have the same format as the records
+	of the L2 log (see disk.go) and a partial record at the end, left by a
+	crash, is truncated.
+
+	When the log grows beyond the rewrite size and to twice the size it had
+	after the last rewrite, it is rewritten in the background with a set per
+	element on the cache. Records appended while it is being rewritten are
+	kept on a buffer and added at the end of the new log before it replaces
+	the old one.
+
+	Evictions and expirations are not recorded, elements that were evicted
+	may be back after a restart until they are evicted again. Only the payload
+	and expiration of elements are recorded, sliding elements are restored
+	with the expiration they had when they were last set or touched.
+
+*/
+
+// FsyncPolicy When writes to the append-only file are synced to disk
+type FsyncPolicy int
+
+// Fsync policies
+const (
+	// FsyncEverySecond Sync once a second, a crash loses at most a second of writes
+	FsyncEverySecond FsyncPolicy = iota
+	// FsyncAlways Sync on every write, nothing written is lost but writes are slower
+	FsyncAlways
+	// FsyncNever Leave it to the operating system
+	FsyncNever
+)
+
+// Flags of an append-only file record
+const (
+	aofSet   = byte(0)
+	aofPurge = byte(1)
+	aofTouch = byte(2)
+	aofFlush = byte(3)
+)
+
+// Default size of the append-only file before it is rewritten
+const defaultAOFRewriteSize = 64 * 1 << 20
+
+// Records appended during a rewrite that are copied to the new file with the
+// lock held, bigger backlogs are copied and synced without it first
+const maxRewriteTail = 64 * 1 << 10
+
+// Rounds of copying records appended during a rewrite without the lock
+const maxRewriteRounds = 4
+
+// aof Append-only file of a Dscache
+type aof struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	policy      FsyncPolicy
+	size        int64
+	rewriteSize int64
+	closed      bool
+
+	// Size after the last rewrite, whether it is being rewritten and the
+	// records appended meanwhile
+	baseSize   int64
+	rewriting  bool
+	rewriteBuf []byte
+
+	// Written since the last sync, for FsyncEverySecond
+	dirty bool
+
+	// First error writing or syncing, returned by Close
+	err error
+
+	ds   *Dscache
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openAOF Open or create the append-only file at path
+func openAOF(path string, policy FsyncPolicy, rewriteSize int64) (*aof, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if rewriteSize <= 0 {
+		rewriteSize = defaultAOFRewriteSize
+	}
+	return &aof{
+		path:        path,
+		file:        file,
+		policy:      policy,
+		rewriteSize: rewriteSize,
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// startAOF Replay the append-only file and start recording writes to it
+func (ds *Dscache) startAOF(a *aof) error {
+	if a == nil {
+		return nil
+	}
+	a.ds = ds
+	if err := a.replay(); err != nil {
+		a.file.Close()
+		return err
+	}
+	ds.aof = a
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].aof = a
+	}
+	if a.policy == FsyncEverySecond {
+		a.wg.Add(1)
+		go a.syncer()
+	}
+	return nil
+}
+
+// replay Apply the records of the file to the cache, truncating it at the first bad record
+func (a *aof) replay() error {
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(io.NewSectionReader(a.file, 0, size))
+	now := time.Now()
+	offset := int64(0)
+	for {
+		flags, expires, key, payload, ok := readRecord(r, size-offset)
+		if !ok {
+			break
+		}
+		offset += int64(recordHeaderSize + len(key) + len(payload))
+
+		var validTill time.Time
+		if expires != 0 {
+			validTill = time.Unix(0, expires)
+		}
+		expired := !validTill.IsZero() && validTill.Before(now)
+		switch {
+		case flags == aofFlush:
+			for i := 0; i < len(a.ds.buckets); i++ {
+				a.ds.buckets[i].flush()
+			}
+		case flags == aofPurge || expired:
+			a.ds.buckets[a.ds.getBucketNumber(key)].purge(key)
+		case flags == aofSet:
+			a.ds.buckets[a.ds.getBucketNumber(key)].restore(key, payload, validTill)
+		case flags == aofTouch:
+			a.ds.buckets[a.ds.getBucketNumber(key)].expireAt(key, validTill)
+		}
+	}
+
+	if offset < size {
+		// Partial or corrupt tail
+		if err := a.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	a.size = offset
+	a.baseSize = offset
+	return nil
+}
+
+// append Append a record, rewriting the file if it has grown too much
+func (a *aof) append(buf []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+	if _, err := a.file.WriteAt(buf, a.size); err != nil {
+		// Whatever was written is overwritten by the next record
+		a.fail(err)
+		return
+	}
+	a.size += int64(len(buf))
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+
+	switch a.policy {
+	case FsyncAlways:
+		a.fail(a.file.Sync())
+	case FsyncEverySecond:
+		a.dirty = true
+	}
+
+	if !a.rewriting && a.size > a.rewriteSize && a.size > 2*a.baseSize {
+		a.rewriting = true
+		a.rewriteBuf = nil
+		a.wg.Add(1)
+		go a.rewrite()
+	}
+}
+
+// fail Keep the first error, the lock must be held
+func (a *aof) fail(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+// syncer Sync the file once a second if it was written
+func (a *aof) syncer() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.done:
+			return
+		}
+		a.mu.Lock()
+		file, dirty := a.file, a.dirty
+		a.dirty = false
+		a.mu.Unlock()
+		if dirty {
+			// Without the lock so that writes don't wait for it. The file may
+			// be replaced by a rewrite meanwhile, the new one is already synced.
+			file.Sync()
+		}
+	}
+}
+
+// rewrite Rewrite the file in the background
+func (a *aof) rewrite() {
+	defer a.wg.Done()
+
+	if err := a.rewriteFile(); err != nil {
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewriteBuf = nil
+		// Don't try again until it doubles
+		a.baseSize = a.size
+		a.mu.Unlock()
+	}
+}
+
+// rewriteFile Write a set for every element on the cache to a new file and replace the old one with it
+func (a *aof) rewriteFile() error {
+	tmpPath := a.path + ".rewrite"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var abort = func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	a.ds.Range(func(key, payload string, ttl time.Duration) bool {
+		var expires int64
+		if ttl != NoExpiration {
+			expires = time.Now().Add(ttl).UnixNano()
+		}
+		_, err = w.Write(encodeRecord(aofSet, expires, key, payload))
+		return err == nil
+	})
+	if err != nil {
+		return abort(err)
+	}
+
+	// Records appended since the rewrite started. The new file is synced
+	// without the lock, writes only wait for the last few records to be copied.
+	for round := 0; ; round++ {
+		if err := w.Flush(); err != nil {
+			return abort(err)
+		}
+		if err := tmp.Sync(); err != nil {
+			return abort(err)
+		}
+		a.mu.Lock()
+		if len(a.rewriteBuf) <= maxRewriteTail || round == maxRewriteRounds {
+			break
+		}
+		buf := a.rewriteBuf
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+		if _, err := w.Write(buf); err != nil {
+			return abort(err)
+		}
+	}
+	defer a.mu.Unlock()
+
+	tail := len(a.rewriteBuf) > 0
+	if _, err := w.Write(a.rewriteBuf); err != nil {
+		return abort(err)
+	}
+	if err := w.Flush(); err != nil {
+		return abort(err)
+	}
+	if tail && a.policy == FsyncAlways {
+		// They were synced on the old file
+		if err := tmp.Sync(); err != nil {
+			return abort(err)
+		}
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return abort(err)
+	}
+
+	a.file.Close()
+	a.file = tmp
+	a.size = info.Size()
+	a.baseSize = a.size
+	a.rewriting = false
+	a.rewriteBuf = nil
+	a.dirty = tail
+	return nil
+}
+
+// close Stop recording writes, let a rewrite in progress finish and sync the file
+func (a *aof) close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	close(a.done)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fail(a.file.Sync())
+	a.fail(a.file.Close())
+	return a.err
+}
+
+// restore Set an element with the time at which it expires, zero if never
+func (lru *lrucache) restore(key, payload string, validTill time.Time) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.store(key, payload, &setting{restore: true, validTill: validTill}, time.Now())
+}
+
+// logSet Record a write of a node, the lock must be held
+func (lru *lrucache) logSet(n *node, now time.Time) {
+	if lru.aof == nil {
+		return
+	}
+	if n.missing {
+		// Tombstones are not restored, but they replace the element
+		lru.logPurge(n.key)
+		return
+	}
+	lru.aof.append(encodeRecord(aofSet, unixNano(n.expiresAt(now)), n.key, n.payload))
+}
+
+// logTouch Record a change of the expiration of a node, the lock must be held
+func (lru *lrucache) logTouch(n *node, now time.Time) {
+	if lru.aof == nil {
+		return
+	}
+	lru.aof.append(encodeRecord(aofTouch, unixNano(n.expiresAt(now)), n.key, ""))
+}
+
+// logPurge Record a purge of a key, the lock must be held
+func (lru *lrucache) logPurge(key string) {
+	if lru.aof == nil {
+		return
+	}
+	lru.aof.append(encodeRecord(aofPurge, 0, key, ""))
+}
+
+// logFlush Record a flush of the cache
+func (a *aof) logFlush() {
+	a.append(encodeRecord(aofFlush, 0, "", ""))
+}
+
+// unixNano Time in nanoseconds, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,250 @@
+package dscache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newAOFCache(t *testing.T, path string, policy FsyncPolicy, rewriteSize uint64) *Dscache {
+	ds, err := Custom(316368, 32, 0, time.Minute, nil, WithAOF(path, policy, rewriteSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncAlways, 0)
+	ds.Set("a", "aaa", time.Minute)
+	ds.Set("b", "bbb", time.Hour)
+	ds.Set("c", "ccc", time.Millisecond*50)
+	ds.Set("d", "ddd", time.Hour)
+	ds.Set("e", "eee", time.Hour)
+	ds.Touch("a", time.Hour*2)
+	ds.Persist("b")
+	ds.Purge("d")
+	ds.SetMissing("e", time.Hour)
+	if err := ds.Close(); err != nil {
+		t.Error("AOF Replay. Test 1. ", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	ds = newAOFCache(t, path, FsyncAlways, 0)
+	defer ds.Close()
+	if ttl, ok := ds.TTL("a"); !ok || ttl < time.Hour {
+		t.Error("AOF Replay. Test 2. Touch should be replayed: ", ttl)
+	}
+	if ttl, ok := ds.TTL("b"); !ok || ttl != NoExpiration {
+		t.Error("AOF Replay. Test 3. Persist should be replayed.")
+	}
+	if ds.Has("c") {
+		t.Error("AOF Replay. Test 4. Expired element should be skipped.")
+	}
+	if ds.Has("d") || ds.Has("e") {
+		t.Error("AOF Replay. Test 5. Purges should be replayed.")
+	}
+	if payload, _ := ds.Get("a"); payload != "aaa" {
+		t.Error("AOF Replay. Test 6. Payload should be replayed.")
+	}
+}
+
+func TestAOFFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncEverySecond, 0)
+	ds.Set("a", "aaa", time.Hour)
+	ds.Flush()
+	ds.Set("b", "bbb", time.Hour)
+	ds.Close()
+
+	ds = newAOFCache(t, path, FsyncEverySecond, 0)
+	defer ds.Close()
+	if ds.Has("a") || !ds.Has("b") {
+		t.Error("AOF Flush. Flush should be replayed.")
+	}
+}
+
+func TestAOFFlushConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncNever, 0)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ds.Set("key"+strconv.Itoa(i), "a", time.Hour)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond)
+		ds.Flush()
+	}
+	close(stop)
+	<-done
+
+	before := make(map[string]bool)
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		before[key] = true
+		return true
+	})
+	ds.Close()
+
+	ds = newAOFCache(t, path, FsyncNever, 0)
+	defer ds.Close()
+	after := 0
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		if !before[key] {
+			t.Error("AOF Flush Concurrent. Flushed element was replayed: ", key)
+			return false
+		}
+		after++
+		return true
+	})
+	if after != len(before) {
+		t.Error("AOF Flush Concurrent. Elements are missing after the replay.")
+	}
+}
+
+func TestAOFCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncNever, 0)
+	ds.Set("a", "aaa", time.Hour)
+	ds.Close()
+
+	info, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord(aofSet, 0, "partial", "payload")[:10])
+	f.Close()
+
+	ds = newAOFCache(t, path, FsyncNever, 0)
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Error("AOF Corrupt Tail. Test 1. Corrupt tail should be truncated.")
+	}
+	ds.Set("b", "bbb", time.Hour)
+	ds.Close()
+
+	ds = newAOFCache(t, path, FsyncNever, 0)
+	defer ds.Close()
+	if !ds.Has("a") || !ds.Has("b") {
+		t.Error("AOF Corrupt Tail. Test 2. Records before and after the truncation should be replayed.")
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncNever, 4096)
+	for i := 0; i < 1000; i++ {
+		ds.Set("key"+strconv.Itoa(i%10), strconv.Itoa(i), time.Hour)
+	}
+
+	// Wait for the background rewrite and rewrite it again
+	a := ds.aof
+	for {
+		a.mu.Lock()
+		rewriting, baseSize := a.rewriting, a.baseSize
+		if !rewriting {
+			a.rewriting = true
+		}
+		a.mu.Unlock()
+		if !rewriting {
+			if baseSize == 0 {
+				t.Error("AOF Rewrite. Test 1. Should be rewritten in the background.")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := a.rewriteFile(); err != nil {
+		t.Error("AOF Rewrite. Test 2. ", err)
+	}
+	ds.Set("last", "last", time.Hour)
+	ds.Close()
+
+	info, _ := os.Stat(path)
+	if info.Size() > 1024 {
+		t.Error("AOF Rewrite. Test 3. Should only have the live elements: ", info.Size())
+	}
+
+	ds = newAOFCache(t, path, FsyncNever, 4096)
+	defer ds.Close()
+	for i := 0; i < 10; i++ {
+		if payload, _ := ds.Get("key" + strconv.Itoa(i)); payload != strconv.Itoa(990+i) {
+			t.Error("AOF Rewrite. Test 4. Should have the last payload of every key.")
+		}
+	}
+	if !ds.Has("last") {
+		t.Error("AOF Rewrite. Test 5. Writes after the rewrite should be kept.")
+	}
+}
+
+func TestAOFRewriteConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncNever, 64*KB)
+	payload := strings.Repeat("a", 200)
+
+	// Rewrites happen while other goroutines write
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				ds.Set("key"+strconv.Itoa(g)+":"+strconv.Itoa(i%50), payload+strconv.Itoa(i), time.Hour)
+			}
+		}(g)
+	}
+	wg.Wait()
+	ds.Close()
+
+	ds = newAOFCache(t, path, FsyncNever, 64*KB)
+	defer ds.Close()
+	for g := 0; g < 4; g++ {
+		for i := 4950; i < 5000; i++ {
+			if got, _ := ds.Get("key" + strconv.Itoa(g) + ":" + strconv.Itoa(i%50)); got != payload+strconv.Itoa(i) {
+				t.Fatal("AOF Rewrite Concurrent. Should have the last payload of every key.")
+			}
+		}
+	}
+}
+
+func TestAOFRewriteBacklog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aof")
+	ds := newAOFCache(t, path, FsyncNever, 0)
+	ds.Set("key", "key", time.Hour)
+	payload := strings.Repeat("a", 400)
+
+	// Records appended during a rewrite, more than are copied with the lock held
+	a := ds.aof
+	a.mu.Lock()
+	a.rewriting = true
+	for i := 0; i < 200; i++ {
+		a.rewriteBuf = append(a.rewriteBuf, encodeRecord(aofSet, 0, "backlog"+strconv.Itoa(i), payload)...)
+	}
+	a.mu.Unlock()
+	if err := a.rewriteFile(); err != nil {
+		t.Error("AOF Rewrite Backlog. Test 1. ", err)
+	}
+	ds.Close()
+
+	ds = newAOFCache(t, path, FsyncNever, 0)
+	defer ds.Close()
+	if !ds.Has("key") {
+		t.Error("AOF Rewrite Backlog. Test 2. Should have the elements on the cache.")
+	}
+	for i := 0; i < 200; i++ {
+		if got, _ := ds.Get("backlog" + strconv.Itoa(i)); got != payload {
+			t.Fatal("AOF Rewrite Backlog. Test 3. Should have the records appended during the rewrite.")
+		}
+	}
+}
@@ -0,0 +1,817 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+	Disk backed L2
+
+	Elements evicted by resize are demoted to an append-only log file with an
+	in-memory index of the offset of each key. Gets that miss the buckets look
+	for the key on the log and promote it back to its bucket, removing it from
+	the log. Sets and purges remove the key from the log too, so it never has
+	an older payload than the buckets.
+
+	Every record is
+
+		crc32 | flags | expiration | key length | payload length | key | payload
+
+	with the crc of everything after it. Removals are appended as records with
+	the delete flag so that the index can be rebuilt when the file is opened
+	again. A crash can leave a partial record at the end, the file is truncated
+	to the last good record on open.
+
+	Writes to the log are queued and applied by a background writer, so that
+	buckets don't wait for the disk or for each other while their lock is
+	held. Queued demotions are found by gets before they are written and
+	queued removals hide the key, demotions are dropped when too many are
+	waiting. Only the writer changes the index, gets read the log without
+	the lock.
+
+	When the live records take more than the budget the oldest ones are
+	dropped. The log is compacted, rewritten with the live records only, when
+	less than half of it is live. Compactions run on the writer too, copying
+	the records without the lock.
+
+	Only the payload and expiration are kept, priorities are lost on
+	demotion. Elements with tags or a namespace are not demoted so that
+	PurgeTag and Namespace.Flush don't miss them.
+
+*/
+
+// Flags of a record
+const (
+	recordSet    = byte(0)
+	recordDelete = byte(1)
+)
+
+// Size of the header of a record
+const recordHeaderSize = 4 + 1 + 8 + 4 + 4
+
+// Dead bytes there must be on the log before it is compacted
+const minCompactGarbage = 1 << 20
+
+// diskEntry Where the last record of a live key is and when it expires (UnixNano, 0 never)
+type diskEntry struct {
+	offset  int64
+	size    int64
+	expires int64
+}
+
+// diskRef Record appended for a key, in order of appending
+type diskRef struct {
+	key    string
+	offset int64
+}
+
+// Demotions that can wait to be written, further ones are dropped
+const maxQueuedDemotions = 4096
+
+// Kinds of writes to the log
+const (
+	diskPut = iota
+	diskRemove
+	diskClear
+	diskSync
+)
+
+// diskOp Write waiting for the writer of the log
+type diskOp struct {
+	kind    int
+	key     string
+	payload string
+	expires int64
+
+	// Closed when a diskSync is reached
+	done chan struct{}
+}
+
+// diskTier Append-only log of demoted elements
+type diskTier struct {
+	// Guards all but end and the contents of the file, which belong to the writer
+	mu       sync.RWMutex
+	path     string
+	file     *os.File
+	index    map[string]diskEntry
+	order    []diskRef
+	live     int64
+	maxBytes int64
+	closed   bool
+
+	// Incremented by clear, a compaction that started before is discarded
+	gen uint64
+
+	// Writes waiting for the writer, the last one of each key and number of puts
+	ops      []*diskOp
+	queued   map[string]*diskOp
+	numPuts  int
+	wake     chan struct{}
+	finished chan struct{}
+
+	// End of the log, only the writer changes it
+	end int64
+
+	numHits       uint64
+	numDemotions  uint64
+	minCompaction int64
+}
+
+// openDiskTier Open or create the log at path, rebuilding the index from it
+func openDiskTier(path string, maxBytes int64) (*diskTier, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskTier{
+		path:          path,
+		file:          file,
+		index:         make(map[string]diskEntry),
+		maxBytes:      maxBytes,
+		queued:        make(map[string]*diskOp),
+		wake:          make(chan struct{}, 1),
+		finished:      make(chan struct{}),
+		minCompaction: minCompactGarbage,
+	}
+	if err := d.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	go d.writer()
+	return d, nil
+}
+
+// load Rebuild the index from the log, truncating it at the first bad record
+func (d *diskTier) load() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(io.NewSectionReader(d.file, 0, size))
+	offset := int64(0)
+	for {
+		flags, expires, key, payload, ok := readRecord(r, size-offset)
+		if !ok {
+			break
+		}
+		recordSize := int64(recordHeaderSize + len(key) + len(payload))
+		if flags == recordDelete {
+			d.forget(key)
+		} else {
+			d.add(key, diskEntry{offset, recordSize, expires})
+		}
+		offset += recordSize
+	}
+
+	if offset < size {
+		// Partial or corrupt tail
+		if err := d.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	d.end = offset
+
+	now := time.Now().UnixNano()
+	for key, e := range d.index {
+		if e.expires != 0 && e.expires < now {
+			d.forget(key)
+		}
+	}
+	for _, key := range d.shrink() {
+		d.appendDelete(key)
+	}
+	return nil
+}
+
+// readRecord Read the next record, ok is false at the end or if it is not valid
+//
+// left is what is left of the file, lengths beyond it are not valid.
+func readRecord(r io.Reader, left int64) (flags byte, expires int64, key, payload string, ok bool) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	keyLen := int64(binary.LittleEndian.Uint32(header[13:]))
+	payloadLen := int64(binary.LittleEndian.Uint32(header[17:]))
+	if recordHeaderSize+keyLen+payloadLen > left {
+		return
+	}
+	data := make([]byte, keyLen+payloadLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[:4]) {
+		return
+	}
+	flags = header[4]
+	expires = int64(binary.LittleEndian.Uint64(header[5:]))
+	return flags, expires, string(data[:keyLen]), string(data[keyLen:]), true
+}
+
+// encodeRecord Encode a record
+func encodeRecord(flags byte, expires int64, key, payload string) []byte {
+	buf := make([]byte, recordHeaderSize+len(key)+len(payload))
+	buf[4] = flags
+	binary.LittleEndian.PutUint64(buf[5:], uint64(expires))
+	binary.LittleEndian.PutUint32(buf[13:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[17:], uint32(len(payload)))
+	copy(buf[recordHeaderSize:], key)
+	copy(buf[recordHeaderSize+len(key):], payload)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// add Point a key to its last record, the lock must be held
+func (d *diskTier) add(key string, e diskEntry) {
+	d.forget(key)
+	d.index[key] = e
+	d.live += e.size
+	d.order = append(d.order, diskRef{key, e.offset})
+}
+
+// forget Forget the record of a key, the lock must be held
+func (d *diskTier) forget(key string) bool {
+	e, ok := d.index[key]
+	if ok {
+		delete(d.index, key)
+		d.live -= e.size
+	}
+	return ok
+}
+
+// enqueue Queue a write for the writer, the lock must be held
+func (d *diskTier) enqueue(op *diskOp) {
+	d.ops = append(d.ops, op)
+	switch op.kind {
+	case diskPut:
+		d.queued[op.key] = op
+		d.numPuts++
+	case diskRemove:
+		d.queued[op.key] = op
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// put Demote an element, expires is when it expires, zero if never
+//
+// It is written in the background, dropped if too many demotions are waiting.
+func (d *diskTier) put(key, payload string, expires time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || d.numPuts >= maxQueuedDemotions {
+		return
+	}
+	d.enqueue(&diskOp{kind: diskPut, key: key, payload: payload, expires: unixNano(expires)})
+}
+
+// get Payload of a key and when it expires, counted as a hit
+func (d *diskTier) get(key string, now time.Time) (string, time.Time, bool) {
+	payload, validTill, ok := d.read(key, now)
+	if ok {
+		atomic.AddUint64(&d.numHits, 1)
+	}
+	return payload, validTill, ok
+}
+
+// read Payload of a key and when it expires
+func (d *diskTier) read(key string, now time.Time) (string, time.Time, bool) {
+	for attempt := 0; attempt < 2; attempt++ {
+		d.mu.RLock()
+		op, queued := d.queued[key]
+		e, ok := d.index[key]
+		file := d.file
+		d.mu.RUnlock()
+
+		if queued {
+			// Not written yet
+			if op.kind != diskPut || (op.expires != 0 && op.expires < now.UnixNano()) {
+				return "", time.Time{}, false
+			}
+			return op.payload, timeOf(op.expires), true
+		}
+		if !ok || file == nil {
+			return "", time.Time{}, false
+		}
+		if e.expires != 0 && e.expires < now.UnixNano() {
+			d.removeEntry(key, e, file)
+			return "", time.Time{}, false
+		}
+		flags, expires, k, payload, ok := readRecord(io.NewSectionReader(file, e.offset, e.size), e.size)
+		if !ok || flags != recordSet || k != key {
+			// The log may have been compacted or cleared meanwhile
+			if d.removeEntry(key, e, file) {
+				return "", time.Time{}, false
+			}
+			continue
+		}
+		// Left on the log until the bucket stores it, see lrucache.store
+		return payload, timeOf(expires), true
+	}
+	return "", time.Time{}, false
+}
+
+// timeOf Time of nanoseconds since the epoch, the zero time for 0
+func timeOf(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// remove Remove a key from the log if it is on it or queued
+//
+// Keys that are not on it only take the read lock, sets of new keys don't wait for each other.
+func (d *diskTier) remove(key string) {
+	d.mu.RLock()
+	needed := d.needsRemove(key)
+	d.mu.RUnlock()
+	if !needed {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed && d.needsRemove(key) {
+		d.enqueue(&diskOp{kind: diskRemove, key: key})
+	}
+}
+
+// needsRemove Whether a key is on the log or queued and not being removed, the lock must be held
+func (d *diskTier) needsRemove(key string) bool {
+	if op, ok := d.queued[key]; ok {
+		return op.kind != diskRemove
+	}
+	_, ok := d.index[key]
+	return ok
+}
+
+// removeEntry Remove a key that expired or could not be read, if it is still at e on file
+//
+// Returns false if it is not, the log changed meanwhile.
+func (d *diskTier) removeEntry(key string, e diskEntry, file *os.File) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, queued := d.queued[key]; queued || d.closed {
+		return true
+	}
+	if current, ok := d.index[key]; !ok || current != e || d.file != file {
+		return false
+	}
+	d.enqueue(&diskOp{kind: diskRemove, key: key})
+	return true
+}
+
+// keys Keys on the log or queued to be written fn returns true for
+func (d *diskTier) keys(fn func(key string) bool) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var keys []string
+	for key := range d.index {
+		if _, queued := d.queued[key]; !queued && fn(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key, op := range d.queued {
+		if op.kind == diskPut && fn(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// writer Apply the queued writes to the log until it is closed and they are all applied
+func (d *diskTier) writer() {
+	defer close(d.finished)
+
+	for {
+		d.mu.Lock()
+		for len(d.ops) == 0 {
+			if d.closed {
+				d.mu.Unlock()
+				return
+			}
+			d.mu.Unlock()
+			<-d.wake
+			d.mu.Lock()
+		}
+		op := d.ops[0]
+		d.ops[0] = nil
+		d.ops = d.ops[1:]
+		if op.kind == diskPut {
+			d.numPuts--
+		}
+		d.mu.Unlock()
+
+		switch op.kind {
+		case diskPut:
+			d.writePut(op)
+		case diskRemove:
+			d.writeRemove(op)
+		case diskClear:
+			if err := d.file.Truncate(0); err == nil {
+				d.end = 0
+			}
+		case diskSync:
+			close(op.done)
+		}
+	}
+}
+
+// current Whether op is still the last write queued for its key, forgetting it if so
+func (d *diskTier) current(op *diskOp) bool {
+	if d.queued[op.key] != op {
+		return false
+	}
+	delete(d.queued, op.key)
+	return true
+}
+
+// writePut Append a demoted element
+func (d *diskTier) writePut(op *diskOp) {
+	d.mu.RLock()
+	superseded := d.queued[op.key] != op
+	d.mu.RUnlock()
+	if superseded {
+		return
+	}
+
+	buf := encodeRecord(recordSet, op.expires, op.key, op.payload)
+	if d.maxBytes > 0 && int64(len(buf)) > d.maxBytes {
+		d.writeRemove(op)
+		return
+	}
+	offset := d.end
+	if _, err := d.file.WriteAt(buf, offset); err != nil {
+		// Whatever was written is overwritten by the next record
+		d.writeRemove(op)
+		return
+	}
+	d.end += int64(len(buf))
+
+	d.mu.Lock()
+	var dropped []string
+	ok := d.current(op)
+	if ok {
+		d.add(op.key, diskEntry{offset, int64(len(buf)), op.expires})
+		d.numDemotions++
+		dropped = d.shrink()
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		// Removed or cleared while it was written
+		d.appendDelete(op.key)
+	}
+	for _, key := range dropped {
+		d.appendDelete(key)
+	}
+	d.maybeCompact()
+}
+
+// writeRemove Append a removal of a key if it is on the log
+func (d *diskTier) writeRemove(op *diskOp) {
+	d.mu.Lock()
+	d.current(op)
+	ok := d.forget(op.key)
+	d.mu.Unlock()
+
+	if ok {
+		d.appendDelete(op.key)
+		d.maybeCompact()
+	}
+}
+
+// appendDelete Append a removal record, only from the writer or on open
+func (d *diskTier) appendDelete(key string) {
+	buf := encodeRecord(recordDelete, 0, key, "")
+	if _, err := d.file.WriteAt(buf, d.end); err == nil {
+		d.end += int64(len(buf))
+	}
+}
+
+// shrink Forget the oldest records until the live ones fit in the budget, the lock must be held
+//
+// Returns the keys forgotten, their removals must be appended.
+func (d *diskTier) shrink() []string {
+	if d.maxBytes <= 0 {
+		return nil
+	}
+	var dropped []string
+	i := 0
+	for d.live > d.maxBytes && i < len(d.order) {
+		ref := d.order[i]
+		if e, ok := d.index[ref.key]; ok && e.offset == ref.offset {
+			d.forget(ref.key)
+			dropped = append(dropped, ref.key)
+		}
+		i++
+	}
+	d.order = d.order[i:]
+	return dropped
+}
+
+// maybeCompact Compact the log if less than half of it is live, only from the writer
+func (d *diskTier) maybeCompact() {
+	d.mu.RLock()
+	garbage, live := d.end-d.live, d.live
+	d.mu.RUnlock()
+	if garbage > live && garbage > d.minCompaction {
+		d.compact()
+	}
+}
+
+// compact Rewrite the log with the live records only, only from the writer
+//
+// The records are copied without the lock, so that demotions and gets don't
+// wait. Only the writer changes the index, except for clear, which discards
+// the compaction.
+func (d *diskTier) compact() error {
+	// Live records in the order they were appended
+	d.mu.RLock()
+	gen := d.gen
+	var order []diskRef
+	var entries []diskEntry
+	for _, ref := range d.order {
+		if e, ok := d.index[ref.key]; ok && e.offset == ref.offset {
+			order = append(order, ref)
+			entries = append(entries, e)
+		}
+	}
+	d.mu.RUnlock()
+
+	tmpPath := d.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var abort = func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	index := make(map[string]diskEntry, len(order))
+	newOrder := make([]diskRef, 0, len(order))
+	w := bufio.NewWriter(tmp)
+	offset := int64(0)
+	for i, ref := range order {
+		e := entries[i]
+		if e.expires != 0 && e.expires < now {
+			continue
+		}
+		buf := make([]byte, e.size)
+		if _, err := d.file.ReadAt(buf, e.offset); err != nil {
+			return abort(err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return abort(err)
+		}
+		index[ref.key] = diskEntry{offset, e.size, e.expires}
+		newOrder = append(newOrder, diskRef{ref.key, offset})
+		offset += e.size
+	}
+	if err := w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return abort(err)
+	}
+
+	d.mu.Lock()
+	if d.gen != gen {
+		d.mu.Unlock()
+		return abort(nil)
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		d.mu.Unlock()
+		return abort(err)
+	}
+	old := d.file
+	d.file = tmp
+	d.index = index
+	d.order = newOrder
+	d.live = offset
+	d.mu.Unlock()
+
+	d.end = offset
+	// Gets reading it meanwhile fail and read the new one
+	old.Close()
+	return nil
+}
+
+// clear Remove every element from the log
+func (d *diskTier) clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.gen++
+	d.index = make(map[string]diskEntry)
+	d.order = nil
+	d.live = 0
+	// Queued writes find they are no longer current
+	d.queued = make(map[string]*diskOp)
+	d.enqueue(&diskOp{kind: diskClear})
+}
+
+// sync Wait for the writes queued so far to be applied
+func (d *diskTier) sync() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	op := &diskOp{kind: diskSync, done: make(chan struct{})}
+	d.enqueue(op)
+	d.mu.Unlock()
+	<-op.done
+}
+
+// size Bytes taken by the live records
+func (d *diskTier) size() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return uint64(d.live)
+}
+
+// stats Number of promotions and demotions
+func (d *diskTier) stats() (hits, demotions uint64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return atomic.LoadUint64(&d.numHits), d.numDemotions
+}
+
+// close Apply the queued writes and close the log file, demotions are ignored afterwards
+func (d *diskTier) close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	d.mu.Unlock()
+
+	<-d.finished
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// demote Write an element being evicted to the L2, the lock must be held
+//
+// Elements with tags or a namespace are not demoted, PurgeTag and Namespace.Flush
+// could not reach them on the L2.
+func (lru *lrucache) demote(n *node, now time.Time) {
+	if lru.l2 == nil || n.missing || n.expired(now) || (n.ext != nil && len(n.ext.tags) > 0) || n.ns != nil {
+		return
+	}
+	lru.l2.put(n.key, n.payload, n.expiresAt(now))
+}
+
+// promote Bring an element back from the L2 to the bucket, the lock must be held
+//
+// Returns nil if it is not on the L2 or it could not be set.
+func (lru *lrucache) promote(key string, now time.Time) *node {
+	if lru.l2 == nil {
+		return nil
+	}
+	payload, validTill, ok := lru.l2.get(key, now)
+	if !ok {
+		return nil
+	}
+	n, err := lru.store(key, payload, &setting{restore: true, validTill: validTill}, now)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// resident Node of a key, promoting it from the L2 if it was demoted, the lock
+// must be held
+//
+// Returns nil if it is neither on the bucket nor on the L2.
+func (lru *lrucache) resident(key string, now time.Time) *node {
+	if n, ok := lru.keys[key]; ok {
+		return n
+	}
+	return lru.promote(key, now)
+}
+
+// peekL2 Payload and time to live of a demoted element, the lock must be held
+//
+// Unlike promote it leaves the element on the L2.
+func (lru *lrucache) peekL2(key string, now time.Time) (string, time.Duration, bool) {
+	if lru.l2 == nil {
+		return "", 0, false
+	}
+	payload, validTill, ok := lru.l2.read(key, now)
+	if !ok {
+		return "", 0, false
+	}
+	if validTill.IsZero() {
+		return payload, NoExpiration, true
+	}
+	return payload, validTill.Sub(now), true
+}
+
+// demotedEntries Append the entries of keys that were demoted and not seen yet, the keys are marked seen
+//
+// Keys promoted back meanwhile are read from the bucket, keys purged are skipped.
+func (lru *lrucache) demotedEntries(keys []string, seen map[string]struct{}, entries []entry) []entry {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		if n, ok := lru.keys[key]; ok {
+			if !n.missing && !n.expired(now) {
+				seen[key] = struct{}{}
+				entries = append(entries, entry{key, n.payload, n.ttl(now)})
+			}
+			continue
+		}
+		if payload, ttl, ok := lru.peekL2(key, now); ok {
+			seen[key] = struct{}{}
+			entries = append(entries, entry{key, payload, ttl})
+		}
+	}
+	return entries
+}
+
+// Close Close the files of the cache, ie: the L2 log and the append-only file
+//
+// The cache should not be used afterwards.
+func (ds *Dscache) Close() error {
+	var err error
+	if ds.aof != nil {
+		err = ds.aof.close()
+	}
+	if ds.l2 != nil {
+		if l2Err := ds.l2.close(); err == nil {
+			err = l2Err
+		}
+	}
+	return err
+}
+
+// NumL2Hits Number of elements promoted back from the L2
+func (ds *Dscache) NumL2Hits() uint64 {
+	if ds.l2 == nil {
+		return 0
+	}
+	hits, _ := ds.l2.stats()
+	return hits
+}
+
+// NumDemotions Number of evicted elements written to the L2
+func (ds *Dscache) NumDemotions() uint64 {
+	if ds.l2 == nil {
+		return 0
+	}
+	_, demotions := ds.l2.stats()
+	return demotions
+}
+
+// L2Size Size in bytes of the elements on the L2
+func (ds *Dscache) L2Size() uint64 {
+	if ds.l2 == nil {
+		return 0
+	}
+	return ds.l2.size()
+}
@@ -0,0 +1,369 @@
+package dscache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var diskPayload = strings.Repeat("a", 1000)
+
+// newL2Cache Cache of a single bucket holding about 10 elements of diskPayload
+func newL2Cache(t *testing.T, path string, maxBytes uint64) *Dscache {
+	ds, err := Custom(12000, 1, 0, time.Minute, nil, WithL2(path, maxBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestL2DemoteAndPromote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	defer ds.Close()
+
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload+strconv.Itoa(i), time.Hour)
+	}
+	// Demotions are written in the background
+	ds.l2.sync()
+	if ds.NumDemotions() == 0 || ds.L2Size() == 0 {
+		t.Error("L2. Test 1. Evicted elements should be demoted.")
+	}
+
+	payload, ok := ds.Get("key0")
+	if !ok || payload != diskPayload+"0" {
+		t.Error("L2. Test 2. Demoted element should be promoted.")
+	}
+	if ds.NumL2Hits() != 1 || !ds.Has("key0") {
+		t.Error("L2. Test 3. Promoted element should be on the cache.")
+	}
+	if ds.PriorityNumGets(PriorityNormal) != ds.NumGets() {
+		t.Error("L2. Test 4. Promotion should count as a hit of its priority.")
+	}
+	if ttl, ok := ds.TTL("key0"); !ok || ttl <= time.Minute*59 {
+		t.Error("L2. Test 5. Promoted element should keep its expiration: ", ttl)
+	}
+
+	// Sets and purges remove it from the L2
+	ds.Set("key1", "new", time.Hour)
+	ds.Purge("key1")
+	if _, ok := ds.Get("key1"); ok {
+		t.Error("L2. Test 6. Purged element should not be promoted.")
+	}
+	ds.Purge("key2")
+	if _, ok := ds.Get("key2"); ok {
+		t.Error("L2. Test 7. Purged element should not be promoted.")
+	}
+
+	ds.Flush()
+	if _, ok := ds.Get("key3"); ok || ds.L2Size() != 0 {
+		t.Error("L2. Test 8. Flush should empty the L2.")
+	}
+}
+
+func TestL2Purges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	defer ds.Close()
+
+	ds.Set("tagged", diskPayload, time.Hour, WithTags("tag"))
+	ds.Namespace("ns", 0).Set("key", diskPayload, time.Hour)
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload, time.Hour)
+	}
+	for _, key := range []string{"key0", "tagged", "ns:key"} {
+		if _, ok := ds.buckets[0].keys[key]; ok {
+			t.Fatal("L2 Purges. Elements should have been evicted.")
+		}
+	}
+
+	ds.Purge("key0")
+	if _, ok := ds.Get("key0"); ok {
+		t.Error("L2 Purges. Test 1. Purge should remove it from the L2.")
+	}
+	ds.PurgeMulti([]string{"key1"})
+	if _, ok := ds.Get("key1"); ok {
+		t.Error("L2 Purges. Test 2. PurgeMulti should remove it from the L2.")
+	}
+	if purged := ds.PurgePrefix("key2"); purged != 11 {
+		t.Error("L2 Purges. Test 3. PurgePrefix should count elements on the L2: ", purged)
+	}
+	if _, ok := ds.Get("key25"); ok {
+		t.Error("L2 Purges. Test 4. PurgePrefix should remove it from the L2.")
+	}
+	ds.PurgeMatch("key3?")
+	if _, ok := ds.Get("key35"); ok {
+		t.Error("L2 Purges. Test 5. PurgeMatch should remove it from the L2.")
+	}
+	ds.Compute("key4", func(old string, exists bool) (string, time.Duration, bool) {
+		return "", 0, false
+	})
+	if _, ok := ds.Get("key4"); ok {
+		t.Error("L2 Purges. Test 6. Compute should remove it from the L2.")
+	}
+
+	// Elements with tags or a namespace are not demoted
+	ds.PurgeTag("tag")
+	if _, ok := ds.Get("tagged"); ok {
+		t.Error("L2 Purges. Test 7. Tagged element should not be on the L2.")
+	}
+	ds.Namespace("ns", 0).Flush()
+	if _, ok := ds.Get("ns:key"); ok {
+		t.Error("L2 Purges. Test 8. Namespaced element should not be on the L2.")
+	}
+}
+
+func TestL2DemotedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	defer ds.Close()
+
+	ds.Set("counter", "5", time.Hour)
+	ds.Set("added", "aaa", time.Hour)
+	ds.Set("replaced", "rrr", time.Hour)
+	ds.Set("computed", "ccc", time.Hour)
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload, time.Hour)
+	}
+	ds.l2.sync()
+	for _, key := range []string{"counter", "added", "replaced", "computed"} {
+		if _, ok := ds.buckets[0].keys[key]; ok {
+			t.Fatal("L2 Demoted Keys. Elements should have been evicted.")
+		}
+	}
+
+	if !ds.Has("counter") {
+		t.Error("L2 Demoted Keys. Test 1. Has should find a demoted element.")
+	}
+	if ttl, ok := ds.TTL("counter"); !ok || ttl <= time.Minute*59 {
+		t.Error("L2 Demoted Keys. Test 2. TTL should find a demoted element: ", ttl)
+	}
+	if _, ok := ds.buckets[0].keys["counter"]; ok || ds.NumL2Hits() != 0 {
+		t.Error("L2 Demoted Keys. Test 3. Has should leave it on the L2.")
+	}
+	if value, err := ds.Incr("counter", 1); err != nil || value != 6 {
+		t.Error("L2 Demoted Keys. Test 4. Incr should increment a demoted element: ", value, err)
+	}
+	if err := ds.Add("added", "new", time.Hour); err != ErrKeyExists {
+		t.Error("L2 Demoted Keys. Test 5. Add should fail on a demoted element.")
+	}
+	if payload, ok := ds.Get("added"); !ok || payload != "aaa" {
+		t.Error("L2 Demoted Keys. Test 6. Add should not overwrite a demoted element.")
+	}
+	if err := ds.Replace("replaced", "new", time.Hour); err != nil {
+		t.Error("L2 Demoted Keys. Test 7. Replace should replace a demoted element.")
+	}
+	if payload, ok := ds.Get("replaced"); !ok || payload != "new" {
+		t.Error("L2 Demoted Keys. Test 8. Replace should replace a demoted element.")
+	}
+	ds.Compute("computed", func(old string, exists bool) (string, time.Duration, bool) {
+		if !exists || old != "ccc" {
+			t.Error("L2 Demoted Keys. Test 9. Compute should get a demoted element.")
+		}
+		return old + "c", time.Hour, true
+	})
+	if payload, ok := ds.Get("computed"); !ok || payload != "cccc" {
+		t.Error("L2 Demoted Keys. Test 10. Compute should update a demoted element.")
+	}
+}
+
+func TestL2Iteration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	defer ds.Close()
+
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload+strconv.Itoa(i), time.Hour)
+	}
+	ds.l2.sync()
+
+	// Promoting elements while visiting them
+	visited := make(map[string]int)
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		visited[key]++
+		if payload != diskPayload+strings.TrimPrefix(key, "key") || ttl <= time.Minute*59 {
+			t.Error("L2 Iteration. Test 1. Incorrect payload or ttl of ", key)
+		}
+		ds.Get("key" + strconv.Itoa(len(visited)))
+		return true
+	})
+	if len(visited) != 100 {
+		t.Error("L2 Iteration. Test 2. Range should visit demoted elements: ", len(visited))
+	}
+	for key, times := range visited {
+		if times != 1 {
+			t.Error("L2 Iteration. Test 3. Element visited more than once: ", key)
+		}
+	}
+
+	var keys []string
+	cursor := uint64(0)
+	for {
+		var found []string
+		cursor, found = ds.Scan(cursor, "key1*", 5)
+		keys = append(keys, found...)
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(keys) != 11 {
+		t.Error("L2 Iteration. Test 4. Scan should return demoted keys: ", keys)
+	}
+}
+
+func TestL2Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds, err := Custom(120000, 8, 0, time.Minute, nil, WithL2(path, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Last payload set of every key, "" if purged
+			last := make(map[string]string)
+			for i := 0; i < 2000; i++ {
+				key := strconv.Itoa(g) + ":" + strconv.Itoa(i%200)
+				switch i % 7 {
+				case 3:
+					ds.Purge(key)
+					last[key] = ""
+					if _, ok := ds.Get(key); ok {
+						t.Error("L2 Concurrent. Purged element should not be promoted: ", key)
+						return
+					}
+				case 5:
+					if got, ok := ds.Get(key); ok && got != last[key] {
+						t.Error("L2 Concurrent. Should get the last payload set: ", key)
+						return
+					}
+				default:
+					payload := diskPayload + strconv.Itoa(i)
+					ds.Set(key, payload, time.Hour)
+					last[key] = payload
+				}
+			}
+			// Elements may have been evicted, demotions are dropped when
+			// too many are waiting, but never older payloads or purged ones
+			for key, payload := range last {
+				if got, ok := ds.Get(key); ok && got != payload {
+					t.Error("L2 Concurrent. Should get the last payload set: ", key)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if ds.NumDemotions() == 0 {
+		t.Error("L2 Concurrent. Elements should have been demoted.")
+	}
+}
+
+func TestL2Expiration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	defer ds.Close()
+
+	ds.Set("short", diskPayload, time.Millisecond*50)
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload, time.Hour)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := ds.Get("short"); ok {
+		t.Error("L2 Expiration. Expired element should not be promoted.")
+	}
+}
+
+func TestL2Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 0)
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload+strconv.Itoa(i), time.Hour)
+	}
+	ds.Purge("key1")
+	ds.Close()
+
+	// Corrupt tail, ie: crash while writing
+	info, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord(recordSet, 0, "partial", diskPayload)[:100])
+	f.Close()
+
+	ds = newL2Cache(t, path, 0)
+	defer ds.Close()
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Error("L2 Reopen. Test 1. Corrupt tail should be truncated.")
+	}
+	if payload, ok := ds.Get("key0"); !ok || payload != diskPayload+"0" {
+		t.Error("L2 Reopen. Test 2. Demoted element should survive a restart.")
+	}
+	if _, ok := ds.Get("key1"); ok {
+		t.Error("L2 Reopen. Test 3. Purged element should stay purged.")
+	}
+	if _, ok := ds.Get("partial"); ok {
+		t.Error("L2 Reopen. Test 4. Partial record should be ignored.")
+	}
+}
+
+func TestL2Budget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	ds := newL2Cache(t, path, 10000)
+	defer ds.Close()
+
+	for i := 0; i < 100; i++ {
+		ds.Set("key"+strconv.Itoa(i), diskPayload, time.Hour)
+	}
+	ds.l2.sync()
+	if ds.L2Size() > 10000 || ds.L2Size() == 0 {
+		t.Error("L2 Budget. Test 1. Should be within budget: ", ds.L2Size())
+	}
+	if _, ok := ds.Get("key0"); ok {
+		t.Error("L2 Budget. Test 2. Oldest elements should be dropped.")
+	}
+	if _, ok := ds.Get("key85"); !ok {
+		t.Error("L2 Budget. Test 3. Newer elements should be kept.")
+	}
+}
+
+func TestL2Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l2")
+	d, err := openDiskTier(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	d.minCompaction = 0
+
+	for i := 0; i < 100; i++ {
+		d.put("key"+strconv.Itoa(i%10), diskPayload+strconv.Itoa(i), time.Time{})
+		d.sync()
+	}
+	if d.end > 2*d.live+int64(len(encodeRecord(recordSet, 0, "key0", diskPayload+"00"))) {
+		t.Error("L2 Compaction. Test 1. Log should be compacted: ", d.end, d.live)
+	}
+	for i := 0; i < 10; i++ {
+		if payload, _, ok := d.get("key"+strconv.Itoa(i), time.Now()); !ok || payload != diskPayload+strconv.Itoa(90+i) {
+			t.Error("L2 Compaction. Test 2. Should have the last payload of every key.")
+		}
+	}
+
+	d.compact()
+	if d.end != d.live {
+		t.Error("L2 Compaction. Test 3. Compacted log should be all live.")
+	}
+	d.close()
+	d, _ = openDiskTier(path, 0)
+	if len(d.index) != 10 {
+		t.Error("L2 Compaction. Test 4. Compacted log should be reopened.")
+	}
+	d.close()
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import "hash/fnv"
+
+// Bits of the filter per key of the window and number of hashes per key,
+// about 1% of false positives when the window is full
+const (
+	doorkeeperBitsPerKey = 10
+	doorkeeperHashes     = 7
+)
+
+// doorkeeper Bloom filter of the keys seen in the current window
+//
+// Used to admit only keys that have been seen at least twice in a window,
+// keys requested only once don't get to evict others. The filter is
+// cleared after window keys have been added.
+type doorkeeper struct {
+	bits   []uint64
+	window int
+	count  int
+}
+
+// newDoorkeeper Create a doorkeeper for a window of keys
+func newDoorkeeper(window int) *doorkeeper {
+	numBits := window * doorkeeperBitsPerKey
+	return &doorkeeper{
+		bits:   make([]uint64, (numBits+63)/64),
+		window: window,
+	}
+}
+
+// admit Whether the key was already seen in the window, adds it if it wasn't
+func (dk *doorkeeper) admit(key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	numBits := uint32(len(dk.bits) * 64)
+	seen := true
+	for i := uint32(0); i < doorkeeperHashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		if dk.bits[bit/64]&(1<<(bit%64)) == 0 {
+			seen = false
+			dk.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	if seen {
+		return true
+	}
+
+	dk.count++
+	if dk.count >= dk.window {
+		dk.reset()
+	}
+	return false
+}
+
+// reset Clear the filter and start a new window
+func (dk *doorkeeper) reset() {
+	for i := range dk.bits {
+		dk.bits[i] = 0
+	}
+	dk.count = 0
+}
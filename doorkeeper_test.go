@@ -0,0 +1,39 @@
+package dscache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDoorkeeper(t *testing.T) {
+	dk := newDoorkeeper(1000)
+
+	if dk.admit("a") {
+		t.Error("Doorkeeper. Test 1. First time should not be admitted.")
+	}
+	if !dk.admit("a") {
+		t.Error("Doorkeeper. Test 2. Second time should be admitted.")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 998; i++ {
+		if dk.admit(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Error("Doorkeeper. Test 3. Too many false positives: ", falsePositives)
+	}
+}
+
+func TestDoorkeeperWindow(t *testing.T) {
+	dk := newDoorkeeper(2)
+
+	dk.admit("a")
+	dk.admit("b")
+
+	// Cleared after 2 keys
+	if dk.admit("a") {
+		t.Error("Doorkeeper Window. Key should have been forgotten.")
+	}
+}
@@ -8,10 +8,18 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Item Element for batch operations
+type Item struct {
+	Key     string
+	Payload string
+	Expires time.Duration
+}
+
 // Dscache Base Structure
 type Dscache struct {
 	buckets         []*lrucache
@@ -19,6 +27,23 @@ type Dscache struct {
 	numGets         uint64
 	numRequests     uint64
 	numSets         uint64
+	numMissingHits  uint64
+
+	nsMu       sync.Mutex
+	namespaces map[string]*Namespace
+
+	// Loads in progress by key and background refreshes, see loader.go
+	loadMu         sync.Mutex
+	loads          map[string]*load
+	refreshWorkers int
+	refreshOnce    sync.Once
+	refreshQueue   chan refresh
+
+	// Disk tier, see disk.go
+	l2 *diskTier
+
+	// Append-only file, see aof.go
+	aof *aof
 }
 
 // Default Number of Buckets in Dscache
@@ -27,6 +52,9 @@ const defaultNumberOfBuckets = int(32)
 // Default Duration of sleep for expiring items workers
 const defaultWorkerSleep = time.Second
 
+// NoExpiration Returned as the TTL of elements that never expire
+const NoExpiration = time.Duration(-1)
+
 // ErrCreateMaxsizeOfZero Returned when attemping to creat DSCache with a maxsize of 0
 var ErrCreateMaxsizeOfZero = errors.New("Building dscache with maxsize of 0")
 
@@ -65,18 +93,31 @@ const (
 // New DSCache with Default values
 //
 // @param 	maxsize		Maxsize of cache in Bytes
-func New(maxsize uint64) (*Dscache, error) {
+// @param	opts	optional configuration, ie: WithMaxItems(1000000)
+func New(maxsize uint64, opts ...Option) (*Dscache, error) {
 
 	if maxsize == 0 {
 		return nil, ErrCreateMaxsizeOfZero
 	}
 
+	cfg := newConfig(opts)
+	if err := cfg.open(); err != nil {
+		return nil, err
+	}
+
 	ds := new(Dscache)
 	ds.buckets = make([]*lrucache, defaultNumberOfBuckets, defaultNumberOfBuckets)
 	for i := 0; i < defaultNumberOfBuckets; i++ {
 		ds.buckets[i] = newLRUCache(maxsize/uint64(defaultNumberOfBuckets), defaultWorkerSleep)
+		cfg.configure(ds.buckets[i], defaultNumberOfBuckets)
 	}
+	ds.refreshWorkers = cfg.refreshWorkers
+	ds.l2 = cfg.l2
 	ds.getBucketNumber = defaultGetBucketNumber(defaultNumberOfBuckets)
+	if err := ds.startAOF(cfg.aof); err != nil {
+		ds.Close()
+		return nil, err
+	}
 	return ds, nil
 }
 
@@ -93,7 +134,8 @@ func New(maxsize uint64) (*Dscache, error) {
 //		0 to disable Expiration Worker
 //		default: 1 Second
 // @param	getBucketNumber	function to calculate the bucket number from a key
-func Custom(maxsize uint64, numberOfBuckets int, gcWorkerSleep time.Duration, workerSleep time.Duration, getBucketNumber func(string) uint32) (*Dscache, error) {
+// @param	opts	optional configuration, ie: WithMaxItems(1000000)
+func Custom(maxsize uint64, numberOfBuckets int, gcWorkerSleep time.Duration, workerSleep time.Duration, getBucketNumber func(string) uint32, opts ...Option) (*Dscache, error) {
 
 	if maxsize == 0 {
 		return nil, ErrCreateMaxsizeOfZero
@@ -115,12 +157,24 @@ func Custom(maxsize uint64, numberOfBuckets int, gcWorkerSleep time.Duration, wo
 		workerSleep = defaultWorkerSleep
 	}
 
+	cfg := newConfig(opts)
+	if err := cfg.open(); err != nil {
+		return nil, err
+	}
+
 	ds := new(Dscache)
 	ds.buckets = make([]*lrucache, numberOfBuckets, numberOfBuckets)
 	for i := 0; i < numberOfBuckets; i++ {
 		ds.buckets[i] = newLRUCache(maxsize/uint64(numberOfBuckets), workerSleep)
+		cfg.configure(ds.buckets[i], numberOfBuckets)
 	}
+	ds.refreshWorkers = cfg.refreshWorkers
+	ds.l2 = cfg.l2
 	ds.getBucketNumber = getBucketNumber
+	if err := ds.startAOF(cfg.aof); err != nil {
+		ds.Close()
+		return nil, err
+	}
 
 	if gcWorkerSleep > 0 {
 		go gcWorker(gcWorkerSleep)
@@ -136,10 +190,169 @@ func Custom(maxsize uint64, numberOfBuckets int, gcWorkerSleep time.Duration, wo
 // @param payload element payload
 //
 // @param expires Time.Duration ie: For how much time should it be valid
-func (ds *Dscache) Set(key, payload string, expires time.Duration) error {
+//
+// @param opts optional settings, ie: WithTags("user:42")
+func (ds *Dscache) Set(key, payload string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].set(key, payload, expires, opts...)
+}
+
+// SetSliding Set element that expires after not being requested for some time
+//
+// Every successful Get extends its life by idle, up to maxLifetime since it was set.
+//
+// @param key element key
+//
+// @param payload element payload
+//
+// @param idle Time.Duration ie: For how much time without requests should it be valid
+//
+// @param maxLifetime Time.Duration ie: Maximum time it can be kept valid, 0 for no limit
+//
+// @param opts optional settings
+func (ds *Dscache) SetSliding(key, payload string, idle, maxLifetime time.Duration, opts ...SetOption) error {
 	Bucket := ds.getBucketNumber(key)
 	atomic.AddUint64(&ds.numSets, 1)
-	return ds.buckets[Bucket].set(key, payload, expires)
+	return ds.buckets[Bucket].setSliding(key, payload, idle, maxLifetime, opts...)
+}
+
+// SetPinned Set an element that is never evicted to make room
+//
+// It still expires and can be purged. Returns ErrPinLimit if pinned elements
+// would take more than the allowed fraction of the bucket, see WithMaxPinnedFraction.
+//
+// @param key element key
+//
+// @param payload element payload
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ds *Dscache) SetPinned(key, payload string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].setPinned(key, payload, expires, opts...)
+}
+
+// Add element only if it is not already on the cache
+//
+// Returns ErrKeyExists if it is.
+//
+// @param key element key
+//
+// @param payload element payload
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ds *Dscache) Add(key, payload string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].add(key, payload, expires, opts...)
+}
+
+// Replace element only if it is already on the cache
+//
+// Returns ErrNotFound if it is not.
+//
+// @param key element key
+//
+// @param payload element payload
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ds *Dscache) Replace(key, payload string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].replace(key, payload, expires, opts...)
+}
+
+// CompareAndSwap Replace element only if it has not been written since it was read
+//
+// Returns ErrNotFound if it is not on the cache and ErrVersionMismatch if it was written
+// after version was obtained through GetWithVersion.
+//
+// @param key element key
+//
+// @param version element version as returned by GetWithVersion
+//
+// @param payload element payload
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ds *Dscache) CompareAndSwap(key string, version uint64, payload string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].compareAndSwap(key, version, payload, expires, opts...)
+}
+
+// Compute Set element from its current payload atomically
+//
+// fn receives the current payload and whether it exists, and returns the new payload, its
+// expiration and whether to keep it (false purges the element). An existing element keeps
+// its tags, pin, priority and namespace, opts only apply to a new one. fn runs while the
+// bucket is locked so it must be fast and must not access the cache.
+//
+// @param key element key
+//
+// @param fn function computing the new payload
+//
+// @param opts optional settings of a new element, ie: WithoutDoorkeeper()
+func (ds *Dscache) Compute(key string, fn func(old string, exists bool) (payload string, expires time.Duration, keep bool), opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].compute(key, fn, opts...)
+}
+
+// Incr Increment a decimal integer element keeping its expiration
+//
+// Returns the new value, ErrNotFound if it is not on the cache and ErrNotNumeric if it
+// is not a decimal integer.
+//
+// @param key element key
+//
+// @param delta amount to add
+func (ds *Dscache) Incr(key string, delta int64) (int64, error) {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].incr(key, delta)
+}
+
+// Decr Decrement a decimal integer element keeping its expiration
+//
+// @param key element key
+//
+// @param delta amount to subtract
+func (ds *Dscache) Decr(key string, delta int64) (int64, error) {
+	return ds.Incr(key, -delta)
+}
+
+// SetMulti Set various elements
+//
+// Elements are grouped by bucket so that each bucket is locked once.
+// Returns the errors of the elements that could not be set by key.
+//
+// @param items elements to set
+//
+// @param opts optional settings of every element, ie: WithoutDoorkeeper()
+func (ds *Dscache) SetMulti(items []Item, opts ...SetOption) map[string]error {
+	groups := make([][]Item, len(ds.buckets))
+	for _, item := range items {
+		Bucket := ds.getBucketNumber(item.Key)
+		groups[Bucket] = append(groups[Bucket], item)
+	}
+
+	errs := make(map[string]error)
+	for Bucket, group := range groups {
+		if len(group) > 0 {
+			ds.buckets[Bucket].setMulti(group, errs, opts...)
+		}
+	}
+	atomic.AddUint64(&ds.numSets, uint64(len(items)))
+	return errs
 }
 
 // Get element
@@ -155,6 +368,126 @@ func (ds *Dscache) Get(key string) (string, bool) {
 	return payload, ok
 }
 
+// GetMulti Get various elements
+//
+// Keys are grouped by bucket so that each bucket is locked once.
+// Returns the elements found by key.
+//
+// @param keys element keys
+func (ds *Dscache) GetMulti(keys []string) map[string]string {
+	groups := ds.groupKeys(keys)
+
+	result := make(map[string]string, len(keys))
+	found := 0
+	for Bucket, group := range groups {
+		if len(group) > 0 {
+			found += ds.buckets[Bucket].getMulti(group, result)
+		}
+	}
+	atomic.AddUint64(&ds.numGets, uint64(found))
+	atomic.AddUint64(&ds.numRequests, uint64(len(keys)))
+	return result
+}
+
+// GetWithVersion Get element and its version
+//
+// The version changes every time the element is written and can be used
+// with CompareAndSwap.
+//
+// @param key element key
+func (ds *Dscache) GetWithVersion(key string) (string, uint64, bool) {
+	Bucket := ds.getBucketNumber(key)
+	payload, version, ok := ds.buckets[Bucket].getWithVersion(key)
+	if ok {
+		atomic.AddUint64(&ds.numGets, 1)
+	}
+	atomic.AddUint64(&ds.numRequests, 1)
+	return payload, version, ok
+}
+
+// GetAndTouch Get element and extend its expiration
+//
+// Sliding expiration in a single operation, counts as a request like Get.
+//
+// @param key element key
+//
+// @param expires Time.Duration ie: For how much time from now should it be valid
+func (ds *Dscache) GetAndTouch(key string, expires time.Duration) (string, bool) {
+	Bucket := ds.getBucketNumber(key)
+	payload, ok := ds.buckets[Bucket].getAndTouch(key, expires)
+	if ok {
+		atomic.AddUint64(&ds.numGets, 1)
+	}
+	atomic.AddUint64(&ds.numRequests, 1)
+	return payload, ok
+}
+
+// Peek element
+//
+// Returns the payload and the time it has left before expiring. Unlike Get
+// it does not promote the element in the LRU order nor count as a request.
+//
+// @param key element key
+func (ds *Dscache) Peek(key string) (string, time.Duration, bool) {
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].peek(key)
+}
+
+// Has element
+//
+// Checks that element exists and has not expired without promoting it nor
+// counting it as a request.
+//
+// @param key element key
+func (ds *Dscache) Has(key string) bool {
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].has(key)
+}
+
+// TTL Time element has left before expiring
+//
+// Returns NoExpiration for elements that were persisted.
+//
+// @param key element key
+func (ds *Dscache) TTL(key string) (time.Duration, bool) {
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].ttl(key)
+}
+
+// Touch Set a new expiration for element without re-setting it
+//
+// @param key element key
+//
+// @param expires Time.Duration ie: For how much time from now should it be valid
+func (ds *Dscache) Touch(key string, expires time.Duration) bool {
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].expireAt(key, time.Now().Add(expires))
+}
+
+// ExpireAt Set the time at which element expires
+//
+// @param key element key
+//
+// @param validTill time at which it expires
+func (ds *Dscache) ExpireAt(key string, validTill time.Time) bool {
+	if validTill.IsZero() {
+		// Zero time is reserved for elements that never expire
+		validTill = time.Now()
+	}
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].expireAt(key, validTill)
+}
+
+// Persist Remove the expiration of element
+//
+// It will only leave the cache through eviction or Purge.
+//
+// @param key element key
+func (ds *Dscache) Persist(key string) bool {
+	Bucket := ds.getBucketNumber(key)
+	return ds.buckets[Bucket].expireAt(key, time.Time{})
+}
+
 // Purge (delete) element
 //
 // @param key element key
@@ -163,6 +496,100 @@ func (ds *Dscache) Purge(key string) bool {
 	return ds.buckets[Bucket].purge(key)
 }
 
+// PurgeTag Purge (delete) all elements with a tag
+//
+// Returns the number of elements purged.
+//
+// @param tag element tag
+func (ds *Dscache) PurgeTag(tag string) int {
+	purged := 0
+	for i := 0; i < len(ds.buckets); i++ {
+		purged += ds.buckets[i].purgeTag(tag)
+	}
+	return purged
+}
+
+// KeysByTag Keys of all elements with a tag
+//
+// @param tag element tag
+func (ds *Dscache) KeysByTag(tag string) []string {
+	var keys []string
+	for i := 0; i < len(ds.buckets); i++ {
+		keys = append(keys, ds.buckets[i].keysByTag(tag)...)
+	}
+	return keys
+}
+
+// PurgeMulti Purge (delete) various elements
+//
+// Returns the number of elements purged.
+//
+// @param keys element keys
+func (ds *Dscache) PurgeMulti(keys []string) int {
+	groups := ds.groupKeys(keys)
+
+	purged := 0
+	for Bucket, group := range groups {
+		if len(group) > 0 {
+			purged += ds.buckets[Bucket].purgeMulti(group)
+		}
+	}
+	return purged
+}
+
+// Flush Purge (delete) all elements
+//
+// All buckets are locked while they are emptied, so that writes that happen
+// meanwhile go either before or after the flush on the buckets, the L2 and the
+// append-only file alike.
+func (ds *Dscache) Flush() {
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].mu.Lock()
+	}
+	if ds.aof != nil {
+		ds.aof.logFlush()
+	}
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].flushLocked()
+	}
+	if ds.l2 != nil {
+		ds.l2.clear()
+	}
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].mu.Unlock()
+	}
+}
+
+// FlushExpired Delete all elements that have expired without waiting for the workers
+//
+// Returns the number of elements deleted.
+func (ds *Dscache) FlushExpired() int {
+	deleted := 0
+	for i := 0; i < len(ds.buckets); i++ {
+		deleted += ds.buckets[i].flushExpired()
+	}
+	return deleted
+}
+
+// FlushAfter Flush the cache after some time, like Memcached's flush_all with a delay
+//
+// The returned timer can be stopped to cancel the flush.
+//
+// @param delay Time.Duration ie: In how much time should it be flushed
+func (ds *Dscache) FlushAfter(delay time.Duration) *time.Timer {
+	return time.AfterFunc(delay, ds.Flush)
+}
+
+// groupKeys Group keys by bucket number
+func (ds *Dscache) groupKeys(keys []string) [][]string {
+	groups := make([][]string, len(ds.buckets))
+	for _, key := range keys {
+		Bucket := ds.getBucketNumber(key)
+		groups[Bucket] = append(groups[Bucket], key)
+	}
+	return groups
+}
+
 // Garbage Collection Worker
 func gcWorker(gcSleepTime time.Duration) {
 	for {
@@ -198,6 +625,10 @@ func (ds *Dscache) Verify() {
 		if err != nil {
 			fmt.Println(err)
 		}
+		err = ds.buckets[i].verifySlots()
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
 }
 
@@ -240,6 +671,71 @@ func (ds *Dscache) NumEvictions() uint64 {
 	return numEvictions
 }
 
+// NumSizeEvictions Number of Evictions to keep the cache under its maxsize
+func (ds *Dscache) NumSizeEvictions() uint64 {
+	numEvictions := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numEvictions += atomic.LoadUint64(&ds.buckets[i].numSizeEvictions)
+	}
+	return numEvictions
+}
+
+// NumItemsEvictions Number of Evictions to keep the cache under its maximum number of items
+func (ds *Dscache) NumItemsEvictions() uint64 {
+	numEvictions := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numEvictions += atomic.LoadUint64(&ds.buckets[i].numItemsEvictions)
+	}
+	return numEvictions
+}
+
+// NumSizeRejections Number of writes rejected for being bigger than allowed by WithMaxItemFraction
+func (ds *Dscache) NumSizeRejections() uint64 {
+	numRejections := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numRejections += atomic.LoadUint64(&ds.buckets[i].numSizeRejections)
+	}
+	return numRejections
+}
+
+// NumDoorkeeperRejections Number of writes of new keys rejected by WithDoorkeeper
+func (ds *Dscache) NumDoorkeeperRejections() uint64 {
+	numRejections := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numRejections += atomic.LoadUint64(&ds.buckets[i].numDoorkeeperRejections)
+	}
+	return numRejections
+}
+
+// NumEarlyExpirations Number of gets that missed an element before it expired, see WithXFetch
+func (ds *Dscache) NumEarlyExpirations() uint64 {
+	numEarly := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numEarly += atomic.LoadUint64(&ds.buckets[i].numEarlyExpirations)
+	}
+	return numEarly
+}
+
+// PinnedSize Size in bytes of pinned elements
+func (ds *Dscache) PinnedSize() uint64 {
+	size := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].mu.Lock()
+		size += ds.buckets[i].pinnedSize
+		ds.buckets[i].mu.Unlock()
+	}
+	return size
+}
+
+// NumRejectedWrites Number of writes rejected with ErrCacheFull in no-evict mode
+func (ds *Dscache) NumRejectedWrites() uint64 {
+	numRejected := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numRejected += atomic.LoadUint64(&ds.buckets[i].numRejectedWrites)
+	}
+	return numRejected
+}
+
 // HitRate Gets/Tries
 func (ds *Dscache) HitRate() float64 {
 	return float64(ds.NumGets()) / float64(ds.NumRequests())
@@ -2,6 +2,9 @@ package dscache
 
 import (
 	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -92,6 +95,301 @@ func TestDscacheExpire(t *testing.T) {
 	}
 }
 
+func TestDscachePeekAndHas(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.Set("a", "aaa", time.Second*10)
+
+	payload, ttl, ok := ds.Peek("a")
+	if !ok || payload != "aaa" || ttl <= 0 {
+		t.Error("Dscache Peek. Incorrect Peek.")
+	}
+	if !ds.Has("a") || ds.Has("b") {
+		t.Error("Dscache Has. Incorrect Has.")
+	}
+	if ds.NumRequests() != 0 || ds.NumGets() != 0 {
+		t.Error("Dscache Peek and Has. Counted as requests.")
+	}
+}
+
+func TestDscacheTouchAndPersist(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.Set("a", "aaa", time.Second/5)
+	ds.Set("b", "bbb", time.Second/5)
+	ds.Set("c", "ccc", time.Second*10)
+
+	ds.Touch("a", time.Second*10)
+	ds.Persist("b")
+	ds.ExpireAt("c", time.Now().Add(time.Second/5))
+
+	if ttl, ok := ds.TTL("a"); !ok || ttl < time.Second*9 {
+		t.Error("Dscache Touch. Incorrect TTL.")
+	}
+	if ttl, ok := ds.TTL("b"); !ok || ttl != NoExpiration {
+		t.Error("Dscache Persist. Incorrect TTL.")
+	}
+
+	time.Sleep(time.Second / 2)
+	if !ds.Has("a") || !ds.Has("b") {
+		t.Error("Dscache Touch and Persist. Element expired.")
+	}
+	if ds.Has("c") {
+		t.Error("Dscache ExpireAt. Did not expire.")
+	}
+}
+
+func TestDscacheSetSliding(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.SetSliding("a", "aaa", time.Second/2, 0)
+	time.Sleep(time.Second / 4)
+	ds.Get("a")
+	time.Sleep(time.Second / 3)
+
+	if _, ok := ds.Get("a"); !ok {
+		t.Error("Dscache SetSliding. Get did not extend expiration.")
+	}
+}
+
+func TestDscacheCompareAndSwap(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.Add("a", "aaa", time.Second*10)
+	_, version, _ := ds.GetWithVersion("a")
+
+	// Another writer gets there first
+	ds.Replace("a", "bbb", time.Second*10)
+
+	if err := ds.CompareAndSwap("a", version, "ccc", time.Second*10); err != ErrVersionMismatch {
+		t.Error("Dscache CompareAndSwap. Stale write was accepted.")
+	}
+	if tmp, _ := ds.Get("a"); tmp != "bbb" {
+		t.Error("Dscache CompareAndSwap. Incorrect payload.")
+	}
+}
+
+func TestDscacheIncrInGoroutines(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+	ds.Set("counter", "0", time.Second*10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds.Incr("counter", 2)
+			ds.Decr("counter", 1)
+		}()
+	}
+	wg.Wait()
+
+	if tmp, _ := ds.Get("counter"); tmp != "1000" {
+		t.Error("Dscache Incr in Goroutines. Lost updates: ", tmp)
+	}
+}
+
+func TestDscacheMulti(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	big := string(make([]byte, 316368))
+	errs := ds.SetMulti([]Item{{"a", "aaa", time.Second * 10}, {"b", "bbb", time.Second * 10}, {"c", big, time.Second * 10}})
+	if len(errs) != 1 || errs["c"] != ErrMaxsize {
+		t.Error("Dscache SetMulti. Incorrect errors.")
+	}
+
+	result := ds.GetMulti([]string{"a", "b", "c"})
+	if len(result) != 2 || result["a"] != "aaa" || result["b"] != "bbb" {
+		t.Error("Dscache GetMulti. Incorrect result.")
+	}
+	if ds.NumRequests() != 3 || ds.NumGets() != 2 {
+		t.Error("Dscache GetMulti. Incorrect stats.")
+	}
+
+	if purged := ds.PurgeMulti([]string{"a", "b", "c"}); purged != 2 || ds.NumObjects() != 0 {
+		t.Error("Dscache PurgeMulti. Incorrect purge.")
+	}
+}
+
+func TestDscachePurgeTag(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.Set("profile:42", "a", time.Second*10, WithTags("user:42", "tenant:7"))
+	ds.Set("orders:42", "b", time.Second*10, WithTags("user:42"))
+	ds.Set("profile:43", "c", time.Second*10, WithTags("user:43", "tenant:7"))
+
+	if keys := ds.KeysByTag("tenant:7"); len(keys) != 2 {
+		t.Error("Dscache KeysByTag. Incorrect keys.")
+	}
+	if purged := ds.PurgeTag("user:42"); purged != 2 {
+		t.Error("Dscache PurgeTag. Incorrect number of purged elements.")
+	}
+	if ds.Has("profile:42") || ds.Has("orders:42") || !ds.Has("profile:43") {
+		t.Error("Dscache PurgeTag. Incorrect elements purged.")
+	}
+	if keys := ds.KeysByTag("tenant:7"); len(keys) != 1 || keys[0] != "profile:43" {
+		t.Error("Dscache KeysByTag. Purged element still tagged.")
+	}
+}
+
+func TestDscacheFlush(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+
+	ds.Set("a", "aaa", time.Second*10)
+	ds.Set("b", "bbb", time.Second*10)
+	ds.Flush()
+	if ds.NumObjects() != 0 {
+		t.Error("Dscache Flush. Not flushed.")
+	}
+
+	ds.Set("a", "aaa", time.Second*10)
+	ds.FlushAfter(time.Second / 5)
+	if !ds.Has("a") {
+		t.Error("Dscache FlushAfter. Flushed too early.")
+	}
+	time.Sleep(time.Second / 2)
+	if ds.Has("a") {
+		t.Error("Dscache FlushAfter. Not flushed.")
+	}
+}
+
+func TestDscacheMaxItems(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, 0, nil, WithMaxItems(40))
+
+	for i := 0; i < 1000; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	if ds.NumObjects() != 40 {
+		t.Error("Dscache MaxItems. Incorrect number of objects: ", ds.NumObjects())
+	}
+	if ds.NumItemsEvictions() != 960 || ds.NumSizeEvictions() != 0 {
+		t.Error("Dscache MaxItems. Incorrect eviction stats.")
+	}
+}
+
+func TestDscacheNoEviction(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, 0, nil, WithMaxItems(40), WithNoEviction())
+
+	rejected := 0
+	for i := 0; i < 100; i++ {
+		if err := ds.Set(strconv.Itoa(i), "a", time.Second*10); err == ErrCacheFull {
+			rejected++
+		}
+	}
+	if ds.NumObjects() != 100-uint32(rejected) || ds.NumEvictions() != 0 {
+		t.Error("Dscache NoEviction. Elements should not be evicted.")
+	}
+	if rejected == 0 || ds.NumRejectedWrites() != uint64(rejected) {
+		t.Error("Dscache NoEviction. Incorrect rejected writes.")
+	}
+}
+
+func TestDscachePinned(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, 0, nil, WithMaxItems(40), WithMaxPinnedFraction(0.1))
+
+	ds.SetPinned("config", "blob", time.Second*10)
+	for i := 0; i < 1000; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	if payload, ok := ds.Get("config"); !ok || payload != "blob" {
+		t.Error("Dscache Pinned. Test 1. Pinned element should not be evicted.")
+	}
+	if ds.PinnedSize() == 0 {
+		t.Error("Dscache Pinned. Test 2. Incorrect pinned size.")
+	}
+	if err := ds.SetPinned("big", strings.Repeat("a", 316368/40), time.Second*10); err != ErrPinLimit {
+		t.Error("Dscache Pinned. Test 3. Should return ErrPinLimit.")
+	}
+	ds.Purge("config")
+	if ds.Has("config") || ds.PinnedSize() != 0 {
+		t.Error("Dscache Pinned. Test 4. Pinned element should be purged.")
+	}
+}
+
+func TestDscacheMaxPinnedFraction(t *testing.T) {
+	// A bucket can't be fully pinned, 1 falls back to the default
+	ds, _ := Custom(316368, 4, 0, 0, nil, WithMaxPinnedFraction(1))
+	if err := ds.SetPinned("big", strings.Repeat("a", 316368/4*3/4), time.Second*10); err != ErrPinLimit {
+		t.Error("Dscache Max Pinned Fraction. Test 1. Should return ErrPinLimit.")
+	}
+
+	ds, _ = Custom(316368, 4, 0, 0, nil, WithMaxPinnedFraction(0.9))
+	if err := ds.SetPinned("big", strings.Repeat("a", 316368/4*3/4), time.Second*10); err != nil {
+		t.Error("Dscache Max Pinned Fraction. Test 2. Should be pinned: ", err)
+	}
+}
+
+func TestDscacheComputeKeepsSettings(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, 0, nil)
+	ns := ds.Namespace("ns", 0)
+
+	ds.SetPinned("a", "aaa", time.Second*10, WithTags("t"), WithPriority(PriorityHigh))
+	ns.Set("b", "bbb", time.Second*10)
+	var appendA = func(old string, exists bool) (string, time.Duration, bool) {
+		return old + "a", time.Minute, true
+	}
+	ds.Compute("a", appendA)
+	ds.Compute("ns:b", appendA)
+
+	if ds.PinnedSize() == 0 || len(ds.KeysByTag("t")) != 1 || ds.PrioritySize(PriorityHigh) == 0 {
+		t.Error("Dscache Compute Keeps Settings. Test 1. Should stay pinned, tagged and high priority.")
+	}
+	if ttl, _ := ds.TTL("a"); ttl <= time.Second*10 {
+		t.Error("Dscache Compute Keeps Settings. Test 2. Expiration should be the one of fn: ", ttl)
+	}
+	if ns.NumObjects() != 1 || ns.Flush() != 1 || ds.Has("ns:b") {
+		t.Error("Dscache Compute Keeps Settings. Test 3. Should stay in its namespace.")
+	}
+}
+
+func TestDscacheAdmission(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, time.Minute, nil, WithMaxItemFraction(0.1), WithDoorkeeper(1000))
+
+	if err := ds.Set("big", strings.Repeat("a", 316368/4/5), time.Second*10); err != ErrNotAdmitted {
+		t.Error("Dscache Admission. Test 1. Oversized element should not be admitted.")
+	}
+	for i := 0; i < 100; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	if ds.NumObjects() > 10 {
+		t.Error("Dscache Admission. Test 2. One hit elements should not be admitted.")
+	}
+	for i := 0; i < 100; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	if ds.NumObjects() != 100 {
+		t.Error("Dscache Admission. Test 3. Elements seen twice should be admitted.")
+	}
+	if ds.NumSizeRejections() != 1 || ds.NumDoorkeeperRejections() < 90 {
+		t.Error("Dscache Admission. Test 4. Incorrect rejections.")
+	}
+	if err := ds.Set("new", "a", time.Second*10, WithoutDoorkeeper()); err != nil || !ds.Has("new") {
+		t.Error("Dscache Admission. Test 5. Set without the doorkeeper should be admitted.")
+	}
+}
+
+func TestDscacheAdmissionBatchAndCompute(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, time.Minute, nil, WithDoorkeeper(1000))
+
+	items := []Item{{Key: "a", Payload: "a", Expires: time.Second * 10}}
+	if errs := ds.SetMulti(items); errs["a"] != ErrNotAdmitted {
+		t.Error("Dscache Admission Batch And Compute. Test 1. SetMulti should not be admitted: ", errs)
+	}
+	items = []Item{{Key: "b", Payload: "b", Expires: time.Second * 10}}
+	if errs := ds.SetMulti(items, WithoutDoorkeeper()); errs["b"] != nil || !ds.Has("b") {
+		t.Error("Dscache Admission Batch And Compute. Test 2. SetMulti should take WithoutDoorkeeper: ", errs)
+	}
+	var set = func(old string, exists bool) (string, time.Duration, bool) {
+		return "c", time.Second * 10, true
+	}
+	if err := ds.Compute("c", set); err != ErrNotAdmitted {
+		t.Error("Dscache Admission Batch And Compute. Test 3. Compute should not be admitted: ", err)
+	}
+	if err := ds.Compute("d", set, WithoutDoorkeeper()); err != nil || !ds.Has("d") {
+		t.Error("Dscache Admission Batch And Compute. Test 4. Compute should take WithoutDoorkeeper: ", err)
+	}
+}
+
 /*
 	BENCHMARKS
 */
@@ -820,3 +1118,57 @@ func Benchmark_GetSetExpire_3(b *testing.B) {
 	}
 
 }
+
+/*
+	#Keys = 17576
+	Payload Size = 10 + 8
+	Keys per batch = 100
+
+	GetMulti compared to a loop of Gets
+*/
+
+func generateBatches() (*Dscache, [][]string) {
+	var letters = "abcdefghijklmnopqrstuvwxyz"
+	ds, _ := Custom(10*MB, 32, 0, time.Second/2, nil)
+	var keys []string
+	for i := 0; i < len(letters); i++ {
+		for j := 0; j < len(letters); j++ {
+			for k := 0; k < len(letters); k++ {
+				var tmpKey = letters[i:i+1] + letters[j:j+1] + letters[k:k+1]
+				ds.Set(tmpKey, "1234567890", time.Second*10)
+				keys = append(keys, tmpKey)
+			}
+		}
+	}
+	var batches [][]string
+	for i := 0; i+100 <= len(keys); i += 100 {
+		batches = append(batches, keys[i:i+100])
+	}
+	return ds, batches
+}
+
+func Benchmark_GetMulti_1(b *testing.B) {
+	ds, batches := generateBatches()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ds.GetMulti(batches[i%len(batches)])
+	}
+}
+
+func Benchmark_GetLoop_1(b *testing.B) {
+	ds, batches := generateBatches()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		batch := batches[i%len(batches)]
+		result := make(map[string]string, len(batch))
+		for _, key := range batch {
+			if payload, ok := ds.Get(key); ok {
+				result[key] = payload
+			}
+		}
+	}
+}
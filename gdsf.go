@@ -0,0 +1,96 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import "container/heap"
+
+/*
+
+	GreedyDual-Size-Frequency eviction
+
+	Every node gets a value of clock + cost * frequency / size and the node
+	with the lowest value is evicted first. The clock of the bucket is set
+	to the value of each evicted node, so nodes that are not requested
+	anymore end up below the ones that were set later and are evicted even
+	if their value was high.
+
+	Nodes are kept on a min heap per priority, the LRU lists are still kept
+	for expiration and namespaces. Pinned nodes are not on the heaps.
+
+*/
+
+// gdsfHeap Min heap of nodes by gdsfValue
+type gdsfHeap []*node
+
+func (h gdsfHeap) Len() int           { return len(h) }
+func (h gdsfHeap) Less(i, j int) bool { return h[i].ext.gdsfValue < h[j].ext.gdsfValue }
+func (h gdsfHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ext.heapIndex = i
+	h[j].ext.heapIndex = j
+}
+
+func (h *gdsfHeap) Push(x interface{}) {
+	n := x.(*node)
+	n.ext.heapIndex = len(*h)
+	*h = append(*h, n)
+}
+
+func (h *gdsfHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return n
+}
+
+// gdsfUpdate Recalculate the value of a node with the current clock
+func (lru *lrucache) gdsfUpdate(n *node) {
+	cost := n.ext.cost
+	if cost <= 0 {
+		cost = 1
+	}
+	n.ext.gdsfValue = lru.gdsfClock + cost*float64(n.ext.freq)/float64(n.size)
+}
+
+// gdsfAdd Add a node to the heap of its priority
+func (lru *lrucache) gdsfAdd(n *node) {
+	if !lru.gdsf || n.pinned {
+		return
+	}
+	lru.gdsfUpdate(n)
+	heap.Push(&lru.gdsfHeaps[n.priority], n)
+}
+
+// gdsfRemove Remove a node from the heap of its priority if it is on it
+func (lru *lrucache) gdsfRemove(n *node) {
+	if n.ext == nil {
+		return
+	}
+	h := &lru.gdsfHeaps[n.priority]
+	if n.ext.heapIndex < len(*h) && (*h)[n.ext.heapIndex] == n {
+		heap.Remove(h, n.ext.heapIndex)
+	}
+}
+
+// gdsfHit Count a hit on a node
+func (lru *lrucache) gdsfHit(n *node) {
+	n.ext.freq++
+	h := &lru.gdsfHeaps[n.priority]
+	if n.ext.heapIndex < len(*h) && (*h)[n.ext.heapIndex] == n {
+		lru.gdsfUpdate(n)
+		heap.Fix(h, n.ext.heapIndex)
+	}
+}
+
+// gdsfVictim Node with the lowest value of the lowest priority, nil if there are none
+func (lru *lrucache) gdsfVictim() *node {
+	for p := PriorityLow; p < numPriorities; p++ {
+		if len(lru.gdsfHeaps[p]) > 0 {
+			return lru.gdsfHeaps[p][0]
+		}
+	}
+	return nil
+}
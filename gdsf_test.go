@@ -0,0 +1,99 @@
+package dscache
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGDSFEviction(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.gdsf = true
+	lru.maxItems = 3
+
+	lru.set("a", "aaa", time.Second*10, WithCost(10))
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second*10)
+	lru.get("b")
+	lru.get("b")
+	lru.set("d", "ddd", time.Second*10)
+
+	// c has the lowest cost and frequency, a is the least recently used but costly
+	if _, ok := lru.keys["c"]; ok {
+		t.Error("GDSF. Test 1. Element with the lowest value should be evicted.")
+	}
+	if _, ok := lru.keys["a"]; !ok {
+		t.Error("GDSF. Test 2. Costly element should not be evicted.")
+	}
+	if lru.gdsfClock == 0 {
+		t.Error("GDSF. Test 3. Clock should be inflated.")
+	}
+	if lru.keys["b"].ext.freq != 3 {
+		t.Error("GDSF. Test 4. Incorrect frequency.")
+	}
+
+	// Bigger elements have a lower value
+	lru.set("e", strings.Repeat("e", 1000), time.Second*10)
+	lru.set("f", "fff", time.Second*10)
+	if _, ok := lru.keys["e"]; ok {
+		t.Error("GDSF. Test 5. Big element should be evicted.")
+	}
+	if len(lru.gdsfHeaps[PriorityNormal]) != len(lru.keys) {
+		t.Error("GDSF. Test 6. Heap does not match keys.")
+	}
+
+	// Purged elements leave the heap
+	lru.purge("a")
+	if len(lru.gdsfHeaps[PriorityNormal]) != len(lru.keys) {
+		t.Error("GDSF. Test 7. Heap does not match keys.")
+	}
+	for i, n := range lru.gdsfHeaps[PriorityNormal] {
+		if n.ext.heapIndex != i {
+			t.Error("GDSF. Test 8. Incorrect heap index.")
+		}
+	}
+}
+
+func TestGDSFPriorityAndPinned(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.gdsf = true
+	lru.maxItems = 3
+
+	lru.setPinned("a", "aaa", time.Second*10)
+	lru.set("b", "bbb", time.Second*10, WithPriority(PriorityHigh), WithCost(0.1))
+	lru.set("c", "ccc", time.Second*10, WithCost(100))
+	lru.set("d", "ddd", time.Second*10, WithCost(100))
+
+	// c goes first even if its value is higher, a is pinned
+	if _, ok := lru.keys["c"]; ok {
+		t.Error("GDSF Priority. Test 1. Lower priority should be evicted first.")
+	}
+	if _, ok := lru.keys["a"]; !ok {
+		t.Error("GDSF Priority. Test 2. Pinned element should not be evicted.")
+	}
+	if len(lru.gdsfHeaps[PriorityNormal]) != 1 || len(lru.gdsfHeaps[PriorityHigh]) != 1 {
+		t.Error("GDSF Priority. Test 3. Pinned element should not be on heaps.")
+	}
+
+	// Changing the priority moves it to its heap
+	lru.set("b", "bbb", time.Second*10)
+	if len(lru.gdsfHeaps[PriorityNormal]) != 2 || len(lru.gdsfHeaps[PriorityHigh]) != 0 {
+		t.Error("GDSF Priority. Test 4. Element should have moved heaps.")
+	}
+}
+
+func TestDscacheGDSF(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, time.Minute, nil, WithMaxItems(40), WithGDSF())
+
+	ds.Set("costly", "a", time.Second*10, WithCost(1000))
+	for i := 0; i < 1000; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	if !ds.Has("costly") {
+		t.Error("Dscache GDSF. Costly element should not be evicted.")
+	}
+	if ds.NumObjects() != 40 {
+		t.Error("Dscache GDSF. Incorrect number of objects: ", ds.NumObjects())
+	}
+}
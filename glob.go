@@ -0,0 +1,101 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+// globMatch Glob style pattern matching
+//
+// Same syntax as Redis' KEYS and SCAN: * matches any sequence of characters,
+// ? any single character, [abc] one of the characters ([^abc] any character
+// but them, [a-z] a range) and \x matches x literally.
+func globMatch(pattern, s string) bool {
+	px, sx := 0, 0
+
+	// Position after the last * and where it started matching, to backtrack
+	starPx, starSx := -1, -1
+
+	for sx < len(s) {
+		matched := false
+		next := px + 1
+		if px < len(pattern) {
+			switch pattern[px] {
+			case '*':
+				starPx, starSx = px+1, sx
+				px++
+				continue
+			case '?':
+				matched = true
+			case '[':
+				matched, next = matchClass(pattern, px+1, s[sx])
+			case '\\':
+				if px+1 < len(pattern) {
+					next = px + 2
+					matched = pattern[px+1] == s[sx]
+				} else {
+					matched = s[sx] == '\\'
+				}
+			default:
+				matched = pattern[px] == s[sx]
+			}
+		}
+
+		if matched {
+			px = next
+			sx++
+		} else if starPx >= 0 {
+			// Let the last * match one more character
+			starSx++
+			px, sx = starPx, starSx
+		} else {
+			return false
+		}
+	}
+
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
+
+// matchClass Match a character against a [...] class starting at px
+//
+// Returns whether it matched and the position after the class.
+func matchClass(pattern string, px int, c byte) (bool, int) {
+	negate := false
+	if px < len(pattern) && pattern[px] == '^' {
+		negate = true
+		px++
+	}
+
+	matched := false
+	for px < len(pattern) && pattern[px] != ']' {
+		switch {
+		case pattern[px] == '\\' && px+1 < len(pattern):
+			px++
+			if pattern[px] == c {
+				matched = true
+			}
+		case px+2 < len(pattern) && pattern[px+1] == '-' && pattern[px+2] != ']':
+			start, end := pattern[px], pattern[px+2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				matched = true
+			}
+			px += 2
+		default:
+			if pattern[px] == c {
+				matched = true
+			}
+		}
+		px++
+	}
+
+	// Skip the closing ], an unclosed class ends with the pattern
+	if px < len(pattern) {
+		px++
+	}
+	return matched != negate, px
+}
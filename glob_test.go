@@ -0,0 +1,42 @@
+package dscache
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "product:123:price", true},
+		{"product:*", "product:123:price", true},
+		{"product:*", "user:123", false},
+		{"product:*:price", "product:123:price", true},
+		{"product:*:price", "product:123:stock", false},
+		{"*:price", "product:123:price", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"a**", "abc", true},
+		{"[", "a", false},
+	}
+
+	for _, test := range tests {
+		if globMatch(test.pattern, test.s) != test.match {
+			t.Error("Glob Match. Incorrect match of pattern: ", test.pattern, " with: ", test.s)
+		}
+	}
+}
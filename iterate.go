@@ -0,0 +1,224 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"iter"
+	"strings"
+	"time"
+)
+
+// Number of slots visited on each lock of a bucket while iterating
+const rangeChunkSize = 256
+
+// Default number of slots visited by a call to Scan
+const defaultScanCount = 10
+
+// entry Element copied out of a bucket while iterating
+type entry struct {
+	key     string
+	payload string
+	ttl     time.Duration
+}
+
+// Range Call fn for every element on the cache until it returns false
+//
+// Buckets are visited one at a time, copying a chunk of elements while the
+// bucket is locked and calling fn once it's unlocked, so fn may access the
+// cache and writes are not blocked for the whole iteration. With WithL2 the
+// elements of a bucket that were demoted are visited after the bucket.
+//
+// Consistency: elements that are on the cache for the whole iteration are visited
+// exactly once, even if they are set again in between. Elements set or purged
+// during the iteration may or may not be visited, and so may elements demoted
+// and promoted back during it, but no element is visited twice. Expired
+// elements and keys known to be missing are skipped.
+// The payload visited is the one the element had when its chunk was copied.
+//
+// @param fn function called with the key, payload and time left of every element
+func (ds *Dscache) Range(fn func(key, payload string, ttl time.Duration) bool) {
+	var entries []entry
+	var seen map[string]struct{}
+	var copyEntry = func(n *node, now time.Time) {
+		if n.missing {
+			return
+		}
+		entries = append(entries, entry{n.key, n.payload, n.ttl(now)})
+		if seen != nil {
+			seen[n.key] = struct{}{}
+		}
+	}
+
+	for i := 0; i < len(ds.buckets); i++ {
+		// Keys demoted before and while the bucket is visited
+		var demoted []string
+		if ds.l2 != nil {
+			demoted = ds.demotedKeys(i, nil)
+			seen = make(map[string]struct{})
+		}
+
+		cursor, more := 0, true
+		for more {
+			entries = entries[:0]
+			cursor, more = ds.buckets[i].scan(cursor, rangeChunkSize, copyEntry)
+			for _, e := range entries {
+				if !fn(e.key, e.payload, e.ttl) {
+					return
+				}
+			}
+		}
+
+		if ds.l2 == nil {
+			continue
+		}
+		demoted = append(demoted, ds.demotedKeys(i, nil)...)
+		for len(demoted) > 0 {
+			chunk := demoted[:min(len(demoted), rangeChunkSize)]
+			demoted = demoted[len(chunk):]
+			entries = ds.buckets[i].demotedEntries(chunk, seen, entries[:0])
+			for _, e := range entries {
+				if !fn(e.key, e.payload, e.ttl) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// demotedKeys Keys of a bucket on the L2 that match returns true for, nil for all
+func (ds *Dscache) demotedKeys(Bucket int, match func(key string) bool) []string {
+	return ds.l2.keys(func(key string) bool {
+		return int(ds.getBucketNumber(key)) == Bucket && (match == nil || match(key))
+	})
+}
+
+// All Iterator over the keys and payloads of all elements on the cache
+//
+// Has the same consistency guarantees as Range.
+func (ds *Dscache) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		ds.Range(func(key, payload string, ttl time.Duration) bool {
+			return yield(key, payload)
+		})
+	}
+}
+
+// Scan Iterate over the keys of the cache with a cursor, like Redis' SCAN
+//
+// Start with a cursor of 0 and call it again with the returned cursor until it
+// returns 0. The cursor encodes the bucket number on its high 32 bits and the
+// position inside the bucket on its low 32 bits, so the iteration is stateless
+// and can be resumed at any time.
+//
+// Keys that are on the cache for the whole iteration are returned exactly once,
+// keys set or purged during the iteration may or may not be returned. With
+// WithL2 the demoted keys of a bucket are returned by the call that finishes
+// it, keys demoted or promoted back during the iteration may be returned twice
+// or not at all. A call may return no keys without the iteration being over.
+//
+// @param cursor cursor returned by the previous call, 0 to start
+//
+// @param match glob style pattern keys must match (*, ?, [...]), "" for all keys
+//
+// @param count number of positions to visit, a hint of the amount of keys returned, default: 10
+func (ds *Dscache) Scan(cursor uint64, match string, count int) (uint64, []string) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	var keys []string
+	var collect = func(n *node, now time.Time) {
+		if !n.missing && (match == "" || globMatch(match, n.key)) {
+			keys = append(keys, n.key)
+		}
+	}
+
+	Bucket := int(cursor >> 32)
+	position := int(uint32(cursor))
+	for Bucket < len(ds.buckets) && count > 0 {
+		next, more := ds.buckets[Bucket].scan(position, count, collect)
+		if next > position {
+			count -= next - position
+		}
+		position = next
+		if !more {
+			if ds.l2 != nil {
+				keys = append(keys, ds.demotedKeys(Bucket, func(key string) bool {
+					return match == "" || globMatch(match, key)
+				})...)
+			}
+			Bucket++
+			position = 0
+		}
+	}
+
+	if Bucket >= len(ds.buckets) {
+		return 0, keys
+	}
+	return uint64(Bucket)<<32 | uint64(position), keys
+}
+
+// PurgePrefix Purge (delete) all elements whose key starts with prefix
+//
+// Buckets are locked one chunk at a time, so the cache can be used while it runs.
+// Elements set during the purge may not be purged. Returns the number of elements purged.
+//
+// @param prefix key prefix, ie: "product:123:"
+func (ds *Dscache) PurgePrefix(prefix string) int {
+	var match = func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+	return ds.purgeWhere(func(n *node) bool {
+		return match(n.key)
+	}, match)
+}
+
+// PurgeMatch Purge (delete) all elements whose key matches a glob style pattern
+//
+// Same behaviour as PurgePrefix. Returns the number of elements purged.
+//
+// @param match glob style pattern (*, ?, [...])
+func (ds *Dscache) PurgeMatch(match string) int {
+	var matchKey = func(key string) bool {
+		return globMatch(match, key)
+	}
+	return ds.purgeWhere(func(n *node) bool {
+		return matchKey(n.key)
+	}, matchKey)
+}
+
+// purgeWhere Purge elements fn returns true for, one chunk at a time
+//
+// Keys on the L2 are purged if onDisk returns true for them, nil to leave the L2 alone.
+func (ds *Dscache) purgeWhere(fn func(n *node) bool, onDisk func(key string) bool) int {
+	purged := 0
+	for i := 0; i < len(ds.buckets); i++ {
+		lru := ds.buckets[i]
+		var purge = func(n *node, now time.Time) {
+			if fn(n) {
+				lru.remove(n.key, n, now)
+				purged++
+			}
+		}
+
+		cursor, more := 0, true
+		for more {
+			cursor, more = lru.scan(cursor, rangeChunkSize, purge)
+		}
+	}
+
+	if ds.l2 == nil || onDisk == nil {
+		return purged
+	}
+	for _, key := range ds.l2.keys(onDisk) {
+		lru := ds.buckets[ds.getBucketNumber(key)]
+		lru.mu.Lock()
+		// It may have been promoted meanwhile
+		lru.remove(key, lru.keys[key], time.Now())
+		lru.mu.Unlock()
+		purged++
+	}
+	return purged
+}
@@ -0,0 +1,185 @@
+package dscache
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRange(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+
+	for i := 0; i < 2000; i++ {
+		ds.Set("key:"+strconv.Itoa(i), strconv.Itoa(i), time.Second*10)
+	}
+	ds.Set("expired", "e", time.Second/5)
+	time.Sleep(time.Second / 2)
+
+	visited := make(map[string]string)
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		if _, ok := visited[key]; ok {
+			t.Error("Range. Key visited twice: ", key)
+		}
+		if ttl <= 0 {
+			t.Error("Range. Incorrect ttl for: ", key)
+		}
+		visited[key] = payload
+		return true
+	})
+
+	if len(visited) != 2000 {
+		t.Error("Range. Incorrect number of elements visited: ", len(visited))
+	}
+	if visited["key:1234"] != "1234" {
+		t.Error("Range. Incorrect payload.")
+	}
+}
+
+func TestRangeStop(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	for i := 0; i < 100; i++ {
+		ds.Set("key:"+strconv.Itoa(i), "a", time.Second*10)
+	}
+
+	count := 0
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Error("Range Stop. Did not stop.")
+	}
+}
+
+func TestRangeWithConcurrentWrites(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	for i := 0; i < 2000; i++ {
+		ds.Set("stable:"+strconv.Itoa(i), "a", time.Second*10)
+	}
+
+	// Purge and set other keys while iterating, stable keys must be visited once
+	visited := make(map[string]int)
+	i := 0
+	ds.Range(func(key, payload string, ttl time.Duration) bool {
+		visited[key]++
+		ds.Set("new:"+strconv.Itoa(i), "b", time.Second*10)
+		ds.Purge("new:" + strconv.Itoa(i-1))
+		i++
+		return true
+	})
+
+	for j := 0; j < 2000; j++ {
+		if visited["stable:"+strconv.Itoa(j)] != 1 {
+			t.Error("Range With Concurrent Writes. Stable key not visited once: ", j)
+		}
+	}
+	ds.Verify()
+}
+
+func TestAll(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	ds.Set("a", "aaa", time.Second*10)
+	ds.Set("b", "bbb", time.Second*10)
+
+	visited := make(map[string]string)
+	for key, payload := range ds.All() {
+		visited[key] = payload
+	}
+	if len(visited) != 2 || visited["a"] != "aaa" || visited["b"] != "bbb" {
+		t.Error("All. Incorrect elements.")
+	}
+}
+
+func TestScan(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	for i := 0; i < 1000; i++ {
+		ds.Set("product:"+strconv.Itoa(i), "a", time.Second*10)
+		ds.Set("user:"+strconv.Itoa(i), "a", time.Second*10)
+	}
+
+	visited := make(map[string]int)
+	cursor := uint64(0)
+	calls := 0
+	for {
+		var keys []string
+		cursor, keys = ds.Scan(cursor, "product:*", 100)
+		for _, key := range keys {
+			visited[key]++
+		}
+
+		// Keys added and purged during the scan
+		ds.Set("user:new:"+strconv.Itoa(calls), "b", time.Second*10)
+		ds.Purge("user:" + strconv.Itoa(calls))
+		calls++
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if len(visited) != 1000 {
+		t.Error("Scan. Incorrect number of keys: ", len(visited))
+	}
+	for key, times := range visited {
+		if times != 1 {
+			t.Error("Scan. Key returned more than once: ", key)
+		}
+		if !globMatch("product:*", key) {
+			t.Error("Scan. Key does not match: ", key)
+		}
+	}
+	if calls < 20 {
+		t.Error("Scan. Count not respected, calls: ", calls)
+	}
+}
+
+func TestScanEmpty(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	cursor, keys := ds.Scan(0, "", 0)
+	if cursor != 0 || len(keys) != 0 {
+		t.Error("Scan Empty. Incorrect scan.")
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	for i := 0; i < 100; i++ {
+		ds.Set(strconv.Itoa(i), "a", time.Second*10)
+	}
+
+	cursor, keys := ds.Scan(0, "", math.MaxInt)
+	if cursor != 0 || len(keys) != 100 {
+		t.Error("Scan Huge Count. Test 1. Should return every key: ", cursor, len(keys))
+	}
+	if cursor, _ := ds.Scan(3, "", math.MaxInt); cursor != 0 {
+		t.Error("Scan Huge Count. Test 2. Should finish the iteration.")
+	}
+	if cursor, _ := ds.Scan(math.MaxUint32, "", math.MaxInt); cursor != 0 {
+		t.Error("Scan Huge Count. Test 3. Cursor past the end should finish the iteration.")
+	}
+}
+
+func TestPurgePrefixAndMatch(t *testing.T) {
+	ds, _ := Custom(10*MB, 8, 0, 0, nil)
+	for i := 0; i < 500; i++ {
+		ds.Set("product:123:"+strconv.Itoa(i), "a", time.Second*10)
+		ds.Set("product:124:"+strconv.Itoa(i), "a", time.Second*10)
+		ds.Set("user:"+strconv.Itoa(i), "a", time.Second*10)
+	}
+
+	if purged := ds.PurgePrefix("product:123:"); purged != 500 {
+		t.Error("Purge Prefix. Incorrect number of purged elements: ", purged)
+	}
+	if ds.Has("product:123:7") || !ds.Has("product:124:7") || ds.NumObjects() != 1000 {
+		t.Error("Purge Prefix. Incorrect elements purged.")
+	}
+
+	if purged := ds.PurgeMatch("*:12?:*"); purged != 500 {
+		t.Error("Purge Match. Incorrect number of purged elements: ", purged)
+	}
+	if ds.Has("product:124:7") || !ds.Has("user:7") || ds.NumObjects() != 500 {
+		t.Error("Purge Match. Incorrect elements purged.")
+	}
+	ds.Verify()
+}
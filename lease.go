@@ -0,0 +1,281 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+	Leases, like memcached's
+
+	A GetWithLease that misses gets a token, only a SetWithLease with that
+	token fills the element. Other misses of the key are denied a lease while
+	it is outstanding, so only one caller goes to the source of the data.
+	Writes and purges of the key invalidate outstanding leases, so a fill that
+	started before them can't overwrite newer data.
+
+	While a lease is outstanding the last payload of the key, the one that
+	expired or was purged, is kept as stale data for denied callers that
+	prefer old data to waiting. It lasts for the lease time and counts
+	towards the size of the bucket.
+
+*/
+
+// LeaseStatus Outcome of a GetWithLease
+type LeaseStatus int
+
+// Lease statuses
+const (
+	// LeaseHit The element is on the cache
+	LeaseHit LeaseStatus = iota
+	// LeaseGranted The element is not on the cache, fill it with SetWithLease and the token
+	LeaseGranted
+	// LeaseDenied Someone else is filling the element, wait and try again
+	LeaseDenied
+	// LeaseStale Someone else is filling the element, the payload returned is stale
+	LeaseStale
+)
+
+// ErrLeaseInvalid Used when a SetWithLease token is not the current lease of the key
+var ErrLeaseInvalid = errors.New("Lease Is Not Valid")
+
+// Default time a lease and stale data last
+const defaultLeaseTTL = 10 * time.Second
+
+// lease Outstanding lease of a key (token 0 if none) and its stale payload
+type lease struct {
+	token    uint64
+	until    time.Time
+	stale    string
+	hasStale bool
+}
+
+// GetWithLease Get an element or a lease to fill it
+//
+// Returns the payload and LeaseHit if the element is on the cache. Otherwise
+// returns a token and LeaseGranted if nobody else holds a lease on the key, the
+// element should be filled with SetWithLease. If somebody does it returns
+// LeaseStale and the stale payload if there is one, LeaseDenied if not. A
+// granted lease also comes with the stale payload if there is one.
+//
+// @param key element key
+func (ds *Dscache) GetWithLease(key string) (string, uint64, LeaseStatus) {
+	Bucket := ds.getBucketNumber(key)
+	payload, token, status := ds.buckets[Bucket].getWithLease(key)
+	if status == LeaseHit {
+		atomic.AddUint64(&ds.numGets, 1)
+	}
+	atomic.AddUint64(&ds.numRequests, 1)
+	return payload, token, status
+}
+
+// SetWithLease Fill an element with the lease token returned by GetWithLease
+//
+// Returns ErrLeaseInvalid if the lease expired or was invalidated by a write or
+// purge of the key since it was granted. If the cache rejects the payload, ie:
+// ErrNotAdmitted or ErrCacheFull, the lease ends too, so that the next miss
+// of the key is granted a new one.
+//
+// @param key element key
+//
+// @param payload element payload
+//
+// @param token lease token
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ds *Dscache) SetWithLease(key, payload string, token uint64, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].setWithLease(key, payload, token, expires, opts...)
+}
+
+// NumLeasesGranted Number of leases given by GetWithLease
+func (ds *Dscache) NumLeasesGranted() uint64 {
+	numGranted := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numGranted += atomic.LoadUint64(&ds.buckets[i].numLeasesGranted)
+	}
+	return numGranted
+}
+
+// NumLeasesDenied Number of GetWithLease misses denied a lease because another was outstanding
+func (ds *Dscache) NumLeasesDenied() uint64 {
+	numDenied := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numDenied += atomic.LoadUint64(&ds.buckets[i].numLeasesDenied)
+	}
+	return numDenied
+}
+
+// getWithLease get an element or a lease to fill it
+func (lru *lrucache) getWithLease(key string) (string, uint64, LeaseStatus) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	old, had := lru.keys[key]
+	if n := lru.lookup(key, now); n != nil && !n.missing {
+		return n.payload, 0, LeaseHit
+	}
+
+	l := lru.currentLease(key, now)
+	if l != nil && l.token != 0 {
+		atomic.AddUint64(&lru.numLeasesDenied, 1)
+		if l.hasStale {
+			return l.stale, 0, LeaseStale
+		}
+		return "", 0, LeaseDenied
+	}
+
+	l = lru.grantLease(key, l, now)
+	stale := l.stale
+	switch {
+	case !had || old.missing:
+	case lru.keys[key] == old:
+		// XFetch missed it, it is still served to others and needs no copy
+		stale = old.payload
+	default:
+		// It expired, the stale copy is smaller than the node it replaces so
+		// it needs no room in no-evict mode
+		lru.setStale(key, l, old.payload)
+		stale = l.stale
+		if !lru.noEvict {
+			lru.resize()
+		}
+	}
+	atomic.AddUint64(&lru.numLeasesGranted, 1)
+	return stale, l.token, LeaseGranted
+}
+
+// setWithLease fill an element if token is its current lease
+func (lru *lrucache) setWithLease(key, payload string, token uint64, expires time.Duration, opts ...SetOption) error {
+	s := applySetOptions(&setting{expires: expires}, opts)
+	s.cond, s.token = setIfLease, token
+	// store ends the lease
+	return lru.write(key, payload, s)
+}
+
+// fillLease Lease for a fill of GetOrLoad, 0 if somebody else holds one
+//
+// Not counted on the lease stats.
+func (lru *lrucache) fillLease(key string) uint64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	l := lru.currentLease(key, now)
+	if l != nil && l.token != 0 {
+		return 0
+	}
+	return lru.grantLease(key, l, now).token
+}
+
+// releaseLease Give up a lease that was not used to fill the element
+func (lru *lrucache) releaseLease(key string, token uint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if l, ok := lru.leases[key]; ok && token != 0 && l.token == token {
+		lru.deleteLease(key, l)
+	}
+}
+
+// grantLease Give a new token for a key, l is its current lease if any. The lock must be held.
+func (lru *lrucache) grantLease(key string, l *lease, now time.Time) *lease {
+	if l == nil {
+		if lru.leases == nil {
+			lru.leases = make(map[string]*lease)
+		}
+		l = new(lease)
+		lru.leases[key] = l
+	}
+	lru.lastLease++
+	l.token = lru.lastLease
+	l.until = now.Add(lru.leaseTTL)
+	return l
+}
+
+// withLease Write only if token is the current lease of the key
+func withLease(token uint64) SetOption {
+	return func(s *setting) {
+		s.cond, s.token = setIfLease, token
+	}
+}
+
+// currentLease Lease of a key if it has not expired, the lock must be held
+func (lru *lrucache) currentLease(key string, now time.Time) *lease {
+	l, ok := lru.leases[key]
+	if !ok {
+		return nil
+	}
+	if l.until.Before(now) {
+		lru.deleteLease(key, l)
+		return nil
+	}
+	return l
+}
+
+// endLease End the lease of a key that was set or whose fill was rejected, the lock must be held
+func (lru *lrucache) endLease(key string) {
+	if l, ok := lru.leases[key]; ok {
+		lru.deleteLease(key, l)
+	}
+}
+
+// invalidateLease Cancel the outstanding lease of a purged key
+//
+// n is the node being purged, nil if the key was not on the cache. Its payload
+// is kept as stale data until the lease would have expired. Nothing is kept if
+// there is no outstanding lease. The lock must be held.
+func (lru *lrucache) invalidateLease(key string, n *node, now time.Time) {
+	if len(lru.leases) == 0 {
+		return
+	}
+	l := lru.currentLease(key, now)
+	if l == nil || l.token == 0 {
+		return
+	}
+	l.token = 0
+	if n != nil && !n.missing {
+		lru.setStale(key, l, n.payload)
+	}
+}
+
+// setStale Keep a payload as the stale data of a lease, the lock must be held
+func (lru *lrucache) setStale(key string, l *lease, payload string) {
+	if l.hasStale {
+		atomic.AddUint64(&lru.size, ^(staleSize(key, l.stale) - 1))
+	}
+	l.stale, l.hasStale = payload, true
+	atomic.AddUint64(&lru.size, staleSize(key, payload))
+}
+
+// deleteLease Delete a lease and its stale data, the lock must be held
+func (lru *lrucache) deleteLease(key string, l *lease) {
+	if l.hasStale {
+		atomic.AddUint64(&lru.size, ^(staleSize(key, l.stale) - 1))
+	}
+	delete(lru.leases, key)
+}
+
+// deleteExpiredLeases Delete leases and stale data that have expired, the lock must be held
+func (lru *lrucache) deleteExpiredLeases(now time.Time) {
+	for key, l := range lru.leases {
+		if l.until.Before(now) {
+			lru.deleteLease(key, l)
+		}
+	}
+}
+
+// staleSize Size in bytes of stale data
+func staleSize(key, payload string) uint64 {
+	return uint64(len(key)) + uint64(len(payload))
+}
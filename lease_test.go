@@ -0,0 +1,177 @@
+package dscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	_, token, status := ds.GetWithLease("a")
+	if status != LeaseGranted || token == 0 {
+		t.Error("Lease. Test 1. Miss should be granted a lease.")
+	}
+	if _, _, status := ds.GetWithLease("a"); status != LeaseDenied {
+		t.Error("Lease. Test 2. Second miss should be denied.")
+	}
+	if err := ds.SetWithLease("a", "aaa", token+1, time.Second*10); err != ErrLeaseInvalid {
+		t.Error("Lease. Test 3. Wrong token should be rejected.")
+	}
+	if err := ds.SetWithLease("a", "aaa", token, time.Second*10); err != nil {
+		t.Error("Lease. Test 4. Lease holder should fill it.")
+	}
+	if payload, _, status := ds.GetWithLease("a"); status != LeaseHit || payload != "aaa" {
+		t.Error("Lease. Test 5. Should hit.")
+	}
+	if err := ds.SetWithLease("a", "aaa", token, time.Second*10); err != ErrLeaseInvalid {
+		t.Error("Lease. Test 6. Lease should be used only once.")
+	}
+	if ds.NumLeasesGranted() != 1 || ds.NumLeasesDenied() != 1 {
+		t.Error("Lease. Test 7. Incorrect stats.")
+	}
+}
+
+func TestLeaseInvalidation(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	ds.Set("a", "old", time.Millisecond*10)
+	time.Sleep(time.Millisecond * 20)
+
+	// Stale data of the expired element
+	stale, token, status := ds.GetWithLease("a")
+	if status != LeaseGranted || stale != "old" {
+		t.Error("Lease Invalidation. Test 1. Lease should come with the stale payload.")
+	}
+	if stale, _, status := ds.GetWithLease("a"); status != LeaseStale || stale != "old" {
+		t.Error("Lease Invalidation. Test 2. Denied miss should get the stale payload.")
+	}
+
+	// Purge while the lease holder reads from the source
+	ds.Purge("a")
+	if err := ds.SetWithLease("a", "read before purge", token, time.Second*10); err != ErrLeaseInvalid {
+		t.Error("Lease Invalidation. Test 3. Purge should invalidate the lease.")
+	}
+	_, token, status = ds.GetWithLease("a")
+	if status != LeaseGranted {
+		t.Error("Lease Invalidation. Test 4. New lease should be granted after purge.")
+	}
+
+	// Set while the lease holder reads from the source
+	ds.Set("a", "new", time.Second*10)
+	if err := ds.SetWithLease("a", "read before set", token, time.Second*10); err != ErrLeaseInvalid {
+		t.Error("Lease Invalidation. Test 5. Set should invalidate the lease.")
+	}
+	if payload, _ := ds.Get("a"); payload != "new" {
+		t.Error("Lease Invalidation. Test 6. Newer data was overwritten.")
+	}
+
+	// Nothing is kept for purges without an outstanding lease
+	ds.Purge("a")
+	if stale, _, status := ds.GetWithLease("a"); status != LeaseGranted || stale != "" {
+		t.Error("Lease Invalidation. Test 7. Purge without a lease should not keep stale data.")
+	}
+}
+
+func TestLeaseInvalidationByPurges(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	var purges = map[string]func(key string){
+		"PurgeMulti": func(key string) {
+			ds.PurgeMulti([]string{key})
+		},
+		"PurgeTag": func(key string) {
+			ds.PurgeTag("tag")
+		},
+		"PurgePrefix": func(key string) {
+			ds.PurgePrefix(key)
+		},
+		"PurgeMatch": func(key string) {
+			ds.PurgeMatch(key)
+		},
+		"Compute": func(key string) {
+			ds.Compute(key, func(old string, exists bool) (string, time.Duration, bool) {
+				return "", 0, false
+			})
+		},
+	}
+	for name, purge := range purges {
+		// Missing keys get leases and are found by all purges
+		ds.SetMissing(name, time.Second*10, WithTags("tag"))
+		_, token, status := ds.GetWithLease(name)
+		if status != LeaseGranted {
+			t.Error("Lease Invalidation By Purges. Test 1. Should be granted a lease: ", name)
+		}
+		purge(name)
+		if err := ds.SetWithLease(name, "read before purge", token, time.Second*10); err != ErrLeaseInvalid {
+			t.Error("Lease Invalidation By Purges. Test 2. Lease should be invalidated: ", name)
+		}
+	}
+}
+
+func TestLeaseExpiration(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil, WithLeaseTTL(time.Millisecond*10))
+
+	_, token, _ := ds.GetWithLease("a")
+	time.Sleep(time.Millisecond * 20)
+	if err := ds.SetWithLease("a", "aaa", token, time.Second*10); err != ErrLeaseInvalid {
+		t.Error("Lease Expiration. Test 1. Expired lease should be rejected.")
+	}
+	if _, _, status := ds.GetWithLease("a"); status != LeaseGranted {
+		t.Error("Lease Expiration. Test 2. New lease should be granted.")
+	}
+
+	var lru = newLRUCache(100000, time.Minute)
+	lru.leaseTTL = time.Millisecond
+	lru.set("a", "aaa", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	if stale, _, _ := lru.getWithLease("a"); stale != "aaa" || lru.size != staleSize("a", "aaa") {
+		t.Error("Lease Expiration. Test 3. Stale data should count towards the size.")
+	}
+	time.Sleep(time.Millisecond * 5)
+	lru.mu.Lock()
+	lru.deleteExpiredLeases(time.Now())
+	lru.mu.Unlock()
+	if len(lru.leases) != 0 || lru.size != 0 {
+		t.Error("Lease Expiration. Test 4. Stale data should expire.")
+	}
+}
+
+func TestLeaseRejectedFill(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil, WithDoorkeeper(1000))
+
+	_, token, _ := ds.GetWithLease("a")
+	if err := ds.SetWithLease("a", "aaa", token, time.Second*10); err != ErrNotAdmitted {
+		t.Error("Lease Rejected Fill. Test 1. First fill should not be admitted: ", err)
+	}
+	_, token, status := ds.GetWithLease("a")
+	if status != LeaseGranted {
+		t.Error("Lease Rejected Fill. Test 2. New lease should be granted after a rejected fill.")
+	}
+	if err := ds.SetWithLease("a", "aaa", token, time.Second*10); err != nil {
+		t.Error("Lease Rejected Fill. Test 3. Second fill should be admitted: ", err)
+	}
+}
+
+func TestLeaseEarlyExpiration(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.noEvict = true
+	// Every get of an element with a recompute time misses early
+	lru.xfetchBeta = 1e12
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lru.set(key, "payload", time.Hour, WithRecomputeTime(time.Second))
+	}
+	lru.maxsize = lru.size
+	size := lru.size
+
+	stale, token, status := lru.getWithLease("a")
+	if status != LeaseGranted || token == 0 || stale != "payload" {
+		t.Error("Lease Early Expiration. Test 1. Early miss should be granted a lease with the payload.")
+	}
+	if len(lru.keys) != 4 || lru.numSizeEvictions != 0 || lru.size != size {
+		t.Error("Lease Early Expiration. Test 2. Early miss should not evict: ", len(lru.keys), lru.numSizeEvictions)
+	}
+	if payload, _, status := lru.getWithLease("a"); status != LeaseHit || payload != "payload" {
+		t.Error("Lease Early Expiration. Test 3. Others should still hit.")
+	}
+}
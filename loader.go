@@ -0,0 +1,184 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Loader Gets the payload of a key from the source of the data
+//
+// Return ErrNotFound if the key does not exist, GetOrLoad records it with SetMissing.
+type Loader func(key string) (string, error)
+
+// ErrLoaderPanic Returned by GetOrLoad when the loader panics, wrapped with the value it panicked with
+var ErrLoaderPanic = errors.New("Loader Panicked")
+
+// Default number of goroutines refreshing stale elements
+const defaultRefreshWorkers = 4
+
+// Refreshes that can wait for a worker, per worker. Stale elements are not
+// refreshed while the queue is full, a later GetOrLoad will try again.
+const refreshQueuePerWorker = 64
+
+// load A call to a loader, shared by everyone who needs the key meanwhile
+type load struct {
+	done    chan struct{}
+	payload string
+	err     error
+}
+
+// refresh A load waiting for a refresh worker
+type refresh struct {
+	l          *load
+	key        string
+	soft, hard time.Duration
+	loader     Loader
+}
+
+// GetOrLoad Get an element, loading it if it is not on the cache
+//
+// Loaded elements are set to expire after hard and to be stale after soft.
+// Stale elements are returned right away and refreshed in the background by a
+// bounded pool of workers (see WithRefreshWorkers), at most one refresh per key
+// at a time. If the refresh fails the stale element is kept until it expires.
+//
+// Elements that are not on the cache are loaded by the calling goroutine,
+// concurrent calls for the same key wait for that load instead of calling the
+// loader again. A loader returning ErrNotFound records the key as missing for
+// soft (hard if soft is 0), until then GetOrLoad returns ErrNotFound without
+// calling the loader.
+//
+// Loads hold a lease on the key (see GetWithLease), a load is returned but not
+// cached if the key is set or purged while the loader runs, if the load takes
+// longer than the lease time or if somebody else holds a lease on the key.
+//
+// @param key element key
+//
+// @param soft Time.Duration ie: For how much time should it be fresh, 0 to never refresh it
+//
+// @param hard Time.Duration ie: For how much time should it be valid
+//
+// @param loader function to get the payload from the source of the data
+func (ds *Dscache) GetOrLoad(key string, soft, hard time.Duration, loader Loader) (string, error) {
+	Bucket := ds.getBucketNumber(key)
+	payload, result, stale := ds.buckets[Bucket].find(key)
+	atomic.AddUint64(&ds.numRequests, 1)
+	switch result {
+	case LookupHit:
+		atomic.AddUint64(&ds.numGets, 1)
+		if stale {
+			ds.refresh(key, payload, soft, hard, loader)
+		}
+		return payload, nil
+	case LookupMissing:
+		atomic.AddUint64(&ds.numMissingHits, 1)
+		return "", ErrNotFound
+	}
+
+	ds.loadMu.Lock()
+	if l, ok := ds.loads[key]; ok {
+		ds.loadMu.Unlock()
+		<-l.done
+		return l.payload, l.err
+	}
+	l := ds.startLoad(key)
+	ds.loadMu.Unlock()
+
+	ds.fill(l, key, soft, hard, loader)
+	return l.payload, l.err
+}
+
+// refresh Queue a stale element to be loaded again unless it is already being loaded
+//
+// stale is the payload it has, returned to whoever waits for the load if the
+// queue is full.
+func (ds *Dscache) refresh(key, stale string, soft, hard time.Duration, loader Loader) {
+	ds.refreshOnce.Do(ds.startRefreshWorkers)
+
+	ds.loadMu.Lock()
+	defer ds.loadMu.Unlock()
+
+	if _, ok := ds.loads[key]; ok {
+		return
+	}
+	l := ds.startLoad(key)
+	select {
+	case ds.refreshQueue <- refresh{l, key, soft, hard, loader}:
+	default:
+		// Queue is full
+		l.payload = stale
+		delete(ds.loads, key)
+		close(l.done)
+	}
+}
+
+// startLoad Register a load of key, must be called with loadMu held
+func (ds *Dscache) startLoad(key string) *load {
+	if ds.loads == nil {
+		ds.loads = make(map[string]*load)
+	}
+	l := &load{done: make(chan struct{})}
+	ds.loads[key] = l
+	return l
+}
+
+// fill Call the loader, store its result and finish the load
+//
+// The result is stored with a lease taken before calling the loader, so it is
+// not stored if the key is set or purged meanwhile: the loader may have read
+// the source of the data before the write.
+//
+// If the loader panics the load finishes with ErrLoaderPanic, so that whoever
+// waits for it doesn't wait forever and the key can be loaded again.
+func (ds *Dscache) fill(l *load, key string, soft, hard time.Duration, loader Loader) {
+	lru := ds.buckets[ds.getBucketNumber(key)]
+	token := lru.fillLease(key)
+	defer func() {
+		if r := recover(); r != nil {
+			l.payload, l.err = "", fmt.Errorf("%w: %v", ErrLoaderPanic, r)
+		}
+		// Unless it was used
+		lru.releaseLease(key, token)
+		ds.loadMu.Lock()
+		delete(ds.loads, key)
+		ds.loadMu.Unlock()
+		close(l.done)
+	}()
+
+	start := time.Now()
+	l.payload, l.err = loader(key)
+	switch l.err {
+	case nil:
+		ds.Set(key, l.payload, hard, WithSoftTTL(soft), WithRecomputeTime(time.Since(start)), withLease(token))
+	case ErrNotFound:
+		if soft <= 0 {
+			soft = hard
+		}
+		ds.SetMissing(key, soft, withLease(token))
+	}
+}
+
+// startRefreshWorkers Start the pool of refresh workers
+func (ds *Dscache) startRefreshWorkers() {
+	workers := ds.refreshWorkers
+	if workers <= 0 {
+		workers = defaultRefreshWorkers
+	}
+	ds.refreshQueue = make(chan refresh, workers*refreshQueuePerWorker)
+	for i := 0; i < workers; i++ {
+		go ds.refreshWorker()
+	}
+}
+
+// refreshWorker Load the stale elements that are queued
+func (ds *Dscache) refreshWorker() {
+	for r := range ds.refreshQueue {
+		ds.fill(r.l, r.key, r.soft, r.hard, r.loader)
+	}
+}
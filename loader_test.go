@@ -0,0 +1,188 @@
+package dscache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	var calls int32
+	var loader = func(key string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "value of " + key, nil
+	}
+
+	if payload, err := ds.GetOrLoad("a", 0, time.Second*10, loader); err != nil || payload != "value of a" {
+		t.Error("GetOrLoad. Test 1. Should load.")
+	}
+	if payload, err := ds.GetOrLoad("a", 0, time.Second*10, loader); err != nil || payload != "value of a" {
+		t.Error("GetOrLoad. Test 2. Should hit.")
+	}
+	if calls != 1 {
+		t.Error("GetOrLoad. Test 3. Loader should be called once.")
+	}
+	if payload, ok := ds.Get("a"); !ok || payload != "value of a" {
+		t.Error("GetOrLoad. Test 4. Loaded element should be on the cache.")
+	}
+}
+
+func TestGetOrLoadConcurrent(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	var calls int32
+	var loader = func(key string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 50)
+		return "aaa", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if payload, err := ds.GetOrLoad("a", 0, time.Second*10, loader); err != nil || payload != "aaa" {
+				t.Error("GetOrLoad Concurrent. Test 1. Incorrect payload.")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Error("GetOrLoad Concurrent. Test 2. Loader should be called once: ", calls)
+	}
+}
+
+func TestGetOrLoadStale(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	var calls int32
+	var fail atomic.Bool
+	var loader = func(key string) (string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if fail.Load() {
+			return "", errors.New("Source Unavailable")
+		}
+		time.Sleep(time.Millisecond * 20)
+		return strconv.Itoa(int(n)), nil
+	}
+
+	ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader)
+	time.Sleep(time.Millisecond * 100)
+
+	// Stale, returned right away and refreshed once in the background
+	for i := 0; i < 5; i++ {
+		if payload, err := ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader); err != nil || payload != "1" {
+			t.Error("GetOrLoad Stale. Test 1. Stale payload should be returned.")
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Error("GetOrLoad Stale. Test 2. Should be refreshed once: ", calls)
+	}
+	if payload, _ := ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader); payload != "2" {
+		t.Error("GetOrLoad Stale. Test 3. Refreshed payload should be returned.")
+	}
+
+	// Failed refreshes keep the stale payload till it expires
+	fail.Store(true)
+	time.Sleep(time.Millisecond * 100)
+	ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader)
+	time.Sleep(time.Millisecond * 100)
+	if payload, err := ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader); err != nil || payload != "2" {
+		t.Error("GetOrLoad Stale. Test 4. Stale payload should be kept.")
+	}
+	time.Sleep(time.Second)
+	if _, err := ds.GetOrLoad("a", time.Millisecond*50, time.Second, loader); err == nil {
+		t.Error("GetOrLoad Stale. Test 5. Expired element should be loaded again.")
+	}
+}
+
+func TestGetOrLoadNotFound(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	var calls int32
+	var loader = func(key string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", ErrNotFound
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := ds.GetOrLoad("a", time.Second, time.Second*10, loader); err != ErrNotFound {
+			t.Error("GetOrLoad Not Found. Test 1. Should return ErrNotFound.")
+		}
+	}
+	if calls != 1 {
+		t.Error("GetOrLoad Not Found. Test 2. Missing key should be recorded.")
+	}
+	if _, result := ds.Lookup("a"); result != LookupMissing {
+		t.Error("GetOrLoad Not Found. Test 3. Should be known missing.")
+	}
+}
+
+func TestGetOrLoadRefreshWorkers(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil, WithRefreshWorkers(2))
+
+	var running, maxRunning int32
+	var loader = func(key string) (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&running, -1)
+		return "aaa", nil
+	}
+
+	for i := 0; i < 20; i++ {
+		ds.Set(strconv.Itoa(i), "aaa", time.Second*10, WithSoftTTL(time.Millisecond))
+	}
+	time.Sleep(time.Millisecond * 5)
+	for i := 0; i < 20; i++ {
+		ds.GetOrLoad(strconv.Itoa(i), time.Second, time.Second*10, loader)
+	}
+	time.Sleep(time.Millisecond * 200)
+	if maxRunning != 2 {
+		t.Error("GetOrLoad Refresh Workers. Refreshes should be bounded by workers: ", maxRunning)
+	}
+}
+
+func TestGetOrLoadPanic(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	release := make(chan struct{})
+	var loader = func(key string) (string, error) {
+		<-release
+		panic("boom")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ds.GetOrLoad("a", 0, time.Second*10, loader); !errors.Is(err, ErrLoaderPanic) {
+				t.Error("GetOrLoad Panic. Test 1. Should return ErrLoaderPanic: ", err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	// The key can be loaded again
+	var ok = func(key string) (string, error) {
+		return "aaa", nil
+	}
+	if payload, err := ds.GetOrLoad("a", 0, time.Second*10, ok); err != nil || payload != "aaa" {
+		t.Error("GetOrLoad Panic. Test 2. Should load after a panic.")
+	}
+}
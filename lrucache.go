@@ -3,6 +3,9 @@ package dscache
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,81 +19,569 @@ type node struct {
 	previous, next *node
 	size           uint64
 	validTill      time.Time
+
+	// Version of the payload, changes on every write
+	version uint64
+
+	// Position in lrucache.slots
+	slot int
+
+	// Namespace it belongs to, nil if none
+	ns *Namespace
+
+	// Pinned nodes are not evicted to make room
+	pinned bool
+
+	// List the node is on
+	priority Priority
+
+	// Tombstone of a key known to be missing, it has no payload
+	missing bool
+
+	// Fields of optional features, nil if the node uses none of them
+	ext *nodeExt
+}
+
+// nodeExt Fields of a node only used by optional features
+//
+// Kept out of node so elements that don't use them don't pay for them.
+type nodeExt struct {
+	// Sliding expiration: idle time added to validTill on every get
+	// and absolute deadline it can't be extended past (zero if none)
+	idle     time.Duration
+	deadline time.Time
+
+	tags []string
+
+	// GDSF cost to recompute the payload, number of requests, value and
+	// position on the heap (see gdsf.go)
+	cost      float64
+	freq      uint64
+	gdsfValue float64
+	heapIndex int
+
+	// Time after which it is stale and GetOrLoad refreshes it (zero if never)
+	staleAt time.Time
+
+	// XFetch: time it takes to recompute the payload and whether a get
+	// already got an early miss
+	recompute    time.Duration
+	earlyClaimed bool
+}
+
+// needsExt Whether a write with these settings uses any field of nodeExt
+func (lru *lrucache) needsExt(s *setting) bool {
+	return lru.gdsf || s.idle > 0 || s.maxLifetime > 0 || len(s.tags) > 0 || s.cost != 0 || s.soft > 0 || s.recompute > 0
+}
+
+// expired Whether the node has expired at a given time
+func (n *node) expired(now time.Time) bool {
+	if n.ext != nil && !n.ext.deadline.IsZero() && n.ext.deadline.Before(now) {
+		return true
+	}
+	return !n.validTill.IsZero() && n.validTill.Before(now)
+}
+
+// ttl Time the node has left before expiring at a given time
+func (n *node) ttl(now time.Time) time.Duration {
+	validTill := n.validTill
+	if n.ext != nil && !n.ext.deadline.IsZero() && (validTill.IsZero() || n.ext.deadline.Before(validTill)) {
+		validTill = n.ext.deadline
+	}
+	if validTill.IsZero() {
+		return NoExpiration
+	}
+	return validTill.Sub(now)
+}
+
+// expiresAt Time at which the node expires, zero if never
+func (n *node) expiresAt(now time.Time) time.Time {
+	ttl := n.ttl(now)
+	if ttl == NoExpiration {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// slide Extend validTill of a sliding node by its idle time
+func (n *node) slide(now time.Time) {
+	if n.ext == nil || n.ext.idle <= 0 {
+		return
+	}
+	n.validTill = now.Add(n.ext.idle)
+	if !n.ext.deadline.IsZero() && n.ext.deadline.Before(n.validTill) {
+		n.validTill = n.ext.deadline
+	}
 }
 
 // LRUCache structure
 type lrucache struct {
 	mu        sync.Mutex
 	keys      map[string]*node
-	listStart *node
-	listEnd   *node
+	listStart [numPriorities]*node
+	listEnd   [numPriorities]*node
 	size      uint64
 
 	maxsize      uint64
+	maxItems     int
 	workerSleep  time.Duration
 	nodeBaseSize uint64
+	nodeExtSize  uint64
 	NumEvictions uint64
+
+	// Evictions to make room by the limit that triggered them
+	numSizeEvictions  uint64
+	numItemsEvictions uint64
+
+	// No-evict mode: writes that don't fit are rejected instead of evicting
+	noEvict           bool
+	numRejectedWrites uint64
+
+	// Size in bytes of pinned nodes and how much of maxsize they can take
+	pinnedSize uint64
+	maxPinned  uint64
+
+	// Size in bytes, hits and evictions of each priority
+	prioritySizes     [numPriorities]uint64
+	priorityHits      [numPriorities]uint64
+	priorityEvictions [numPriorities]uint64
+
+	// Admission: maximum size of a node (0 for no limit other than maxsize),
+	// filter of new keys (nil if none) and rejections by each
+	maxItemSize             uint64
+	doorkeeper              *doorkeeper
+	numSizeRejections       uint64
+	numDoorkeeperRejections uint64
+
+	// Probabilistic early expiration (0 if disabled), early misses given and
+	// maximum fraction of the expiration taken away at random on set
+	xfetchBeta          float64
+	numEarlyExpirations uint64
+	ttlJitter           float64
+
+	// Leases and stale data by key, last token given, how long they last and
+	// leases granted and denied, see lease.go
+	leases           map[string]*lease
+	lastLease        uint64
+	leaseTTL         time.Duration
+	numLeasesGranted uint64
+	numLeasesDenied  uint64
+
+	// GreedyDual-Size-Frequency eviction instead of LRU, see gdsf.go
+	gdsf      bool
+	gdsfClock float64
+	gdsfHeaps [numPriorities]gdsfHeap
+
+	// Log evicted elements are demoted to, shared by every bucket, see disk.go
+	l2 *diskTier
+
+	// Append-only file writes are recorded to, shared by every bucket, see aof.go
+	aof *aof
+
+	// Last version given to a node in this bucket
+	lastVersion uint64
+
+	// Nodes by a position that does not change while they are on the cache,
+	// used for iteration. Positions of deleted nodes are reused.
+	slots     []*node
+	freeSlots []int
+
+	// Nodes by tag
+	tags map[string]map[*node]struct{}
+
+	// Size in bytes used by each namespace on this bucket
+	nsSizes map[*Namespace]uint64
 }
 
+// Size in bytes of the header of a tag on a node plus its entry on the tag index
+const tagEntrySize = uint64(unsafe.Sizeof("")*2 + unsafe.Sizeof((*node)(nil)))
+
 // ErrMaxsize Used when a key + payload is bigger than allowed LRU Cache size
 var ErrMaxsize = errors.New("Value is Bigger than Allowed Maxsize")
 
+// ErrNotFound Used when a conditional write requires a key that is not on the cache
+var ErrNotFound = errors.New("Key Not Found")
+
+// ErrKeyExists Used when a conditional write requires a key not to be on the cache
+var ErrKeyExists = errors.New("Key Already Exists")
+
+// ErrNotNumeric Used when incrementing an element whose payload is not a decimal integer
+var ErrNotNumeric = errors.New("Value is Not a Decimal Integer")
+
+// ErrVersionMismatch Used when compare and swap is attempted with a version that is no longer current
+var ErrVersionMismatch = errors.New("Version Does Not Match")
+
+// ErrCacheFull Used in no-evict mode when there is no room left for a write
+var ErrCacheFull = errors.New("Cache is Full")
+
+// ErrPinLimit Used when pinning an element would exceed the space allowed for pinned elements
+var ErrPinLimit = errors.New("Pinned Elements Exceed Allowed Size")
+
+// ErrNotAdmitted Used when a write is rejected by the admission policy
+var ErrNotAdmitted = errors.New("Value Was Not Admitted")
+
+// Default fraction of maxsize that pinned elements can take
+const defaultMaxPinnedFraction = 0.5
+
 // newLRUCache Constructor
 func newLRUCache(maxsize uint64, workerSleep time.Duration) *lrucache {
 	lru := new(lrucache)
 	lru.keys = make(map[string]*node)
+	lru.tags = make(map[string]map[*node]struct{})
+	lru.nsSizes = make(map[*Namespace]uint64)
 	lru.size = 0
 	lru.maxsize = maxsize
+	lru.maxPinned = uint64(float64(maxsize) * defaultMaxPinnedFraction)
 	lru.workerSleep = workerSleep
+	lru.leaseTTL = defaultLeaseTTL
 	lru.nodeBaseSize = lru.calculateBaseNodeSize()
+	lru.nodeExtSize = lru.calculateNodeExtSize()
 	go lru.worker()
 	return lru
 }
 
+// setting Parameters of a write to the cache
+type setting struct {
+	expires     time.Duration
+	idle        time.Duration
+	maxLifetime time.Duration
+
+	// Condition for the write to happen, expected version for setIfVersion
+	// and lease token for setIfLease
+	cond    int
+	version uint64
+	token   uint64
+
+	// Keep the expiration, tags, pin, priority and cost of the element being overwritten
+	keep bool
+
+	// Keep all of them but the expiration, which is set after expires
+	keepMeta bool
+
+	tags      []string
+	ns        *Namespace
+	pinned    bool
+	cost      float64
+	missing   bool
+	soft      time.Duration
+	recompute time.Duration
+
+	// Priority given with WithPriority, defaultPriority if hasPriority is false
+	priority    Priority
+	hasPriority bool
+
+	// Element restored from disk, it expires at validTill instead of after
+	// expires (never if zero) and it was already admitted
+	restore   bool
+	validTill time.Time
+
+	// Skip the doorkeeper, see WithoutDoorkeeper
+	admit bool
+}
+
+// Write conditions
+const (
+	setAlways = iota
+	setIfAbsent
+	setIfPresent
+	setIfVersion
+	setIfLease
+)
+
 // set an element
-func (lru *lrucache) set(key, payload string, expires time.Duration) error {
+func (lru *lrucache) set(key, payload string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: expires}, opts))
+}
 
-	// Verify Size
-	nodeSize := (uint64(len(key)) + uint64(len(payload))) + lru.nodeBaseSize // Size of node structure is 8
-	if nodeSize > lru.maxsize {
-		// Node Exceeds Maxsize
-		return ErrMaxsize
+// setSliding set an element that expires after being idle for some time
+//
+// maxLifetime caps the total time it can be kept alive, 0 for no cap.
+func (lru *lrucache) setSliding(key, payload string, idle, maxLifetime time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: idle, idle: idle, maxLifetime: maxLifetime}, opts))
+}
+
+// setPinned set an element that is not evicted to make room
+func (lru *lrucache) setPinned(key, payload string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: expires, pinned: true}, opts))
+}
+
+// setMissing record a key as known to be missing
+func (lru *lrucache) setMissing(key string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, "", applySetOptions(&setting{expires: expires, missing: true}, opts))
+}
+
+// add an element only if it is not on the cache
+func (lru *lrucache) add(key, payload string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: expires, cond: setIfAbsent}, opts))
+}
+
+// replace an element only if it is on the cache
+func (lru *lrucache) replace(key, payload string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: expires, cond: setIfPresent}, opts))
+}
+
+// compareAndSwap replace an element only if its version has not changed
+func (lru *lrucache) compareAndSwap(key string, version uint64, payload string, expires time.Duration, opts ...SetOption) error {
+	return lru.write(key, payload, applySetOptions(&setting{expires: expires, cond: setIfVersion, version: version}, opts))
+}
+
+// setMulti set various elements
+//
+// Errors are added to errs by key.
+func (lru *lrucache) setMulti(items []Item, errs map[string]error, opts ...SetOption) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	for _, item := range items {
+		if _, err := lru.store(item.Key, item.Payload, applySetOptions(&setting{expires: item.Expires}, opts), now); err != nil {
+			errs[item.Key] = err
+		}
 	}
+}
 
+// write an element if the condition of the setting is met
+func (lru *lrucache) write(key, payload string, s *setting) error {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	// Expired elements count as absent, they are overwritten by store
+	now := time.Now()
+	old := lru.resident(key, now)
+	// Tombstones count as absent too
+	ok := old != nil && !old.expired(now) && !old.missing
+
+	switch s.cond {
+	case setIfAbsent:
+		if ok {
+			return ErrKeyExists
+		}
+	case setIfPresent:
+		if !ok {
+			return ErrNotFound
+		}
+	case setIfVersion:
+		if !ok {
+			return ErrNotFound
+		}
+		if old.version != s.version {
+			return ErrVersionMismatch
+		}
+	case setIfLease:
+		if l := lru.currentLease(key, now); l == nil || s.token == 0 || l.token != s.token {
+			return ErrLeaseInvalid
+		}
+	}
+
+	_, err := lru.store(key, payload, s, now)
+	if err != nil && s.cond == setIfLease {
+		// Nobody else would fill it until the lease expires
+		lru.endLease(key)
+	}
+	return err
+}
+
+// store an element
+//
+// Must be called with the lock held.
+func (lru *lrucache) store(key, payload string, s *setting, now time.Time) (*node, error) {
+
 	// Check to see if it was already set
-	old, ok := lru.keys[key]
+	n, ok := lru.keys[key]
+	keep := ok && (s.keep || s.keepMeta)
+	tags, ns, pinned, priority := s.tags, s.ns, s.pinned, defaultPriority
+	if s.hasPriority {
+		priority = s.priority
+	}
+	hasExt := lru.needsExt(s)
+	if keep {
+		tags, ns, pinned, priority = nil, n.ns, n.pinned, n.priority
+		if n.ext != nil {
+			tags = n.ext.tags
+		}
+		hasExt = n.ext != nil
+	}
+
+	// Verify Size
+	nodeSize := (uint64(len(key)) + uint64(len(payload))) + lru.nodeBaseSize + lru.tagsSize(tags) // Size of node structure is 8
+	if hasExt {
+		nodeSize += lru.nodeExtSize
+	}
+	if nodeSize > lru.maxsize || (ns != nil && ns.bucketQuota > 0 && nodeSize > ns.bucketQuota) {
+		// Node Exceeds Maxsize
+		return nil, ErrMaxsize
+	}
+
+	// Admission
+	if lru.maxItemSize > 0 && nodeSize > lru.maxItemSize {
+		atomic.AddUint64(&lru.numSizeRejections, 1)
+		return nil, ErrNotAdmitted
+	}
+	if !ok && !pinned && !s.restore && !s.admit && lru.doorkeeper != nil && !lru.doorkeeper.admit(key) {
+		atomic.AddUint64(&lru.numDoorkeeperRejections, 1)
+		return nil, ErrNotAdmitted
+	}
+
+	if pinned {
+		pinnedSize := lru.pinnedSize + nodeSize
+		if ok && n.pinned {
+			pinnedSize -= n.size
+		}
+		if pinnedSize > lru.maxPinned {
+			return nil, ErrPinLimit
+		}
+	}
+
+	if lru.noEvict && !lru.fits(n, nodeSize, ns) {
+		// Reclaim expired elements and try again, they may include n
+		if lru.deleteExpired(now) > 0 {
+			return lru.store(key, payload, s, now)
+		}
+		atomic.AddUint64(&lru.numRejectedWrites, 1)
+		return nil, ErrCacheFull
+	}
+
+	var deadline time.Time
+	if s.maxLifetime > 0 {
+		deadline = now.Add(s.maxLifetime)
+	}
+
 	if ok {
 		// Key exists
-		oldSize := old.size
-		old.payload = payload
-		old.size = nodeSize
-		old.validTill = time.Now().Add(expires)
+		lru.unaccount(n)
+		lru.gdsfRemove(n)
+		if n.priority != priority {
+			// Move it to the list of its new priority
+			lru.unlink(n)
+		}
+		oldSize := n.size
+		n.payload = payload
+		n.size = nodeSize
 		diff := int64(nodeSize) - int64(oldSize)
 		if diff > 0 {
 			atomic.AddUint64(&lru.size, uint64(diff))
 		} else {
-			atomic.AddUint64(&lru.size, ^uint64(diff-1))
+			atomic.AddUint64(&lru.size, ^uint64(-diff-1))
 		}
-		lru.sendToTop(old)
 	} else {
 		// create and add Node
-		n := new(node)
+		n = new(node)
 		n.key = key
 		n.payload = payload
 		n.size = nodeSize
-		n.validTill = time.Now().Add(expires)
 		lru.keys[key] = n
+		lru.takeSlot(n)
 		atomic.AddUint64(&lru.size, nodeSize)
-		lru.sendToTop(n)
 	}
+	if !keep || s.keepMeta {
+		if s.restore {
+			n.validTill = s.validTill
+		} else {
+			expires := s.expires
+			if lru.ttlJitter > 0 && s.idle == 0 {
+				expires -= time.Duration(rand.Float64() * lru.ttlJitter * float64(expires))
+			}
+			n.validTill = now.Add(expires)
+		}
+	}
+	if !keep {
+		if hasExt {
+			if n.ext == nil {
+				n.ext = &nodeExt{freq: 1}
+			}
+			n.ext.idle = s.idle
+			n.ext.deadline = deadline
+			lru.setTags(n, s.tags)
+			n.ext.cost = s.cost
+			n.ext.staleAt = time.Time{}
+			if s.soft > 0 {
+				n.ext.staleAt = now.Add(s.soft)
+			}
+			n.ext.recompute = s.recompute
+		} else if n.ext != nil {
+			lru.setTags(n, nil)
+			n.ext = nil
+		}
+	}
+	if n.ext != nil {
+		n.ext.earlyClaimed = false
+	}
+	n.ns = ns
+	n.pinned = pinned
+	n.priority = priority
+	n.missing = s.missing
+	lru.account(n)
+	lru.gdsfAdd(n)
+	lru.lastVersion++
+	n.version = lru.lastVersion
+	lru.sendToTop(n)
 
-	if lru.size > lru.maxsize {
-		lru.resize()
+	// Outstanding leases would overwrite this
+	if len(lru.leases) > 0 {
+		lru.endLease(key)
 	}
-	return nil
+
+	// So that an older payload is not promoted
+	if lru.l2 != nil {
+		lru.l2.remove(key)
+	}
+	lru.logSet(n, now)
+
+	if !lru.noEvict && ns != nil && ns.bucketQuota > 0 && lru.nsSizes[ns] > ns.bucketQuota {
+		lru.shrinkNamespace(ns, n)
+	}
+	lru.resize()
+	return n, nil
+}
+
+// compute an element from its current payload
+//
+// fn is executed with the lock held, it must not access the cache.
+func (lru *lrucache) compute(key string, fn func(old string, exists bool) (string, time.Duration, bool), opts ...SetOption) error {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	old := ""
+	n := lru.resident(key, now)
+	exists := n != nil && !n.expired(now) && !n.missing
+	if exists {
+		old = n.payload
+	}
+
+	payload, expires, keep := fn(old, exists)
+	if !keep {
+		lru.remove(key, n, now)
+		return nil
+	}
+	// Only the expiration comes from fn, an existing element keeps its tags, pin, priority and namespace
+	s := &setting{expires: expires, keepMeta: exists}
+	if !exists {
+		s = applySetOptions(s, opts)
+	}
+	_, err := lru.store(key, payload, s, now)
+	return err
+}
+
+// incr add delta to a decimal integer element keeping its expiration
+func (lru *lrucache) incr(key string, delta int64) (int64, error) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	n := lru.resident(key, now)
+	if n == nil || n.expired(now) || n.missing {
+		return 0, ErrNotFound
+	}
+	value, err := strconv.ParseInt(n.payload, 10, 64)
+	if err != nil {
+		return 0, ErrNotNumeric
+	}
+	value += delta
+	if _, err = lru.store(key, strconv.FormatInt(value, 10), &setting{keep: true}, now); err != nil {
+		return 0, err
+	}
+	return value, nil
 }
 
 // get an element
@@ -98,69 +589,349 @@ func (lru *lrucache) get(key string) (string, bool) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
-	n, ok := lru.keys[key]
-	if !ok {
-		// It doesn't exist
+	n := lru.lookup(key, time.Now())
+	if n == nil || n.missing {
+		return "", false
+	}
+	return n.payload, true
+}
+
+// find an element telling apart keys known to be missing from unknown ones
+//
+// Also returns whether the element is stale.
+func (lru *lrucache) find(key string) (string, LookupResult, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	n := lru.lookup(key, now)
+	switch {
+	case n == nil:
+		return "", LookupUnknown, false
+	case n.missing:
+		return "", LookupMissing, false
+	}
+	return n.payload, LookupHit, n.ext != nil && !n.ext.staleAt.IsZero() && n.ext.staleAt.Before(now)
+}
+
+// getWithVersion get an element and its version
+func (lru *lrucache) getWithVersion(key string) (string, uint64, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	n := lru.lookup(key, time.Now())
+	if n == nil || n.missing {
+		return "", 0, false
+	}
+	return n.payload, n.version, true
+}
+
+// getAndTouch get an element and extend its expiration
+func (lru *lrucache) getAndTouch(key string, expires time.Duration) (string, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	n := lru.lookup(key, now)
+	if n == nil || n.missing {
 		return "", false
 	}
-	if n.validTill.Before(time.Now()) {
+	n.validTill = now.Add(expires)
+	lru.logTouch(n, now)
+	return n.payload, true
+}
+
+// getMulti get various elements into result
+//
+// Returns the number of elements found.
+func (lru *lrucache) getMulti(keys []string, result map[string]string) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	found := 0
+	for _, key := range keys {
+		if n := lru.lookup(key, now); n != nil && !n.missing {
+			result[key] = n.payload
+			found++
+		}
+	}
+	return found
+}
+
+// lookup Find an element for a get and promote it
+//
+// Deletes it if it has expired, tombstones are returned too. Must be called
+// with the lock held.
+func (lru *lrucache) lookup(key string, now time.Time) *node {
+	n, ok := lru.keys[key]
+	if !ok {
+		// It doesn't exist, it may have been demoted, a promotion counts as a hit
+		if n = lru.promote(key, now); n == nil {
+			return nil
+		}
+	} else if n.expired(now) {
 		// It has expired
 		lru.delete(n)
-		return "", false
+		return nil
+	}
+	if lru.expiresEarly(n, now) {
+		// Miss for this get only, the caller is expected to set it again
+		n.ext.earlyClaimed = true
+		atomic.AddUint64(&lru.numEarlyExpirations, 1)
+		return nil
 	}
+	n.slide(now)
 	lru.sendToTop(n)
-	return n.payload, true
+	if !n.missing {
+		atomic.AddUint64(&lru.priorityHits[n.priority], 1)
+	}
+	if lru.gdsf {
+		lru.gdsfHit(n)
+	}
+	return n
 }
 
-func (lru *lrucache) purge(key string) bool {
+// expiresEarly XFetch, whether a get should miss a node before it expires
+//
+// The probability increases as the expiration approaches and with the time it
+// takes to recompute the payload. Only one get misses per write.
+func (lru *lrucache) expiresEarly(n *node, now time.Time) bool {
+	if lru.xfetchBeta <= 0 || n.ext == nil || n.ext.recompute <= 0 || n.ext.earlyClaimed || n.missing {
+		return false
+	}
+	ttl := n.ttl(now)
+	if ttl == NoExpiration {
+		return false
+	}
+	return float64(n.ext.recompute)*lru.xfetchBeta*-math.Log(rand.Float64()) >= float64(ttl)
+}
+
+// peek an element
+//
+// Unlike get it does not promote the node nor delete it if it has expired.
+func (lru *lrucache) peek(key string) (string, time.Duration, bool) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
+	now := time.Now()
 	n, ok := lru.keys[key]
 	if !ok {
+		// It may have been demoted, it is left on the L2
+		return lru.peekL2(key, now)
+	}
+	if n.expired(now) || n.missing {
+		return "", 0, false
+	}
+	return n.payload, n.ttl(now), true
+}
+
+// has Verifies an element exists and has not expired, tombstones don't count
+func (lru *lrucache) has(key string) bool {
+	_, _, ok := lru.peek(key)
+	return ok
+}
+
+// ttl Time an element has left before expiring
+func (lru *lrucache) ttl(key string) (time.Duration, bool) {
+	_, ttl, ok := lru.peek(key)
+	return ttl, ok
+}
+
+// expireAt Change the time at which an element expires
+//
+// A zero validTill means the element never expires.
+func (lru *lrucache) expireAt(key string, validTill time.Time) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	n := lru.resident(key, time.Now())
+	if n == nil || n.missing {
+		// Tombstones count as absent
+		return false
+	}
+	if n.expired(time.Now()) {
+		lru.delete(n)
 		return false
 	}
-	lru.delete(n)
+	n.validTill = validTill
+	if validTill.IsZero() && n.ext != nil {
+		// Persisted, no longer sliding
+		n.ext.idle = 0
+		n.ext.deadline = time.Time{}
+	}
+	lru.logTouch(n, time.Now())
 	return true
 }
 
+func (lru *lrucache) purge(key string) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	n, ok := lru.keys[key]
+	if !ok {
+		n = nil
+		_, _, ok = lru.peekL2(key, now)
+	}
+	lru.remove(key, n, now)
+	return ok
+}
+
+// purgeMulti purge various elements
+//
+// Returns the number of elements purged.
+func (lru *lrucache) purgeMulti(keys []string) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for _, key := range keys {
+		n, ok := lru.keys[key]
+		if !ok {
+			n = nil
+			_, _, ok = lru.peekL2(key, now)
+		}
+		lru.remove(key, n, now)
+		if ok {
+			purged++
+		}
+	}
+	return purged
+}
+
+// remove Delete a key purged by the user, the lock must be held
+//
+// n is its node, nil if it is not on the bucket. Even then it may be on the L2,
+// have an outstanding lease or have been recorded on the append-only file
+// before being evicted, so it is removed from all of them.
+func (lru *lrucache) remove(key string, n *node, now time.Time) {
+	lru.invalidateLease(key, n, now)
+	if lru.l2 != nil {
+		lru.l2.remove(key)
+	}
+	lru.logPurge(key)
+	if n != nil {
+		lru.delete(n)
+	}
+}
+
+// flush Delete all elements
+func (lru *lrucache) flush() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.flushLocked()
+}
+
+// flushLocked Delete all elements, the lock must be held
+func (lru *lrucache) flushLocked() {
+	if len(lru.nsSizes) > 0 {
+		for _, n := range lru.keys {
+			lru.unaccount(n)
+		}
+	}
+	lru.keys = make(map[string]*node)
+	lru.tags = make(map[string]map[*node]struct{})
+	lru.listStart = [numPriorities]*node{}
+	lru.listEnd = [numPriorities]*node{}
+	lru.slots = nil
+	lru.freeSlots = nil
+	lru.pinnedSize = 0
+	lru.leases = nil
+	lru.prioritySizes = [numPriorities]uint64{}
+	lru.gdsfHeaps = [numPriorities]gdsfHeap{}
+	lru.gdsfClock = 0
+	atomic.StoreUint64(&lru.size, 0)
+}
+
+// flushExpired Delete all elements that have expired
+//
+// Returns the number of elements deleted.
+func (lru *lrucache) flushExpired() int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	return lru.deleteExpired(time.Now())
+}
+
+// deleteExpired Delete all expired elements, the lock must be held
+func (lru *lrucache) deleteExpired(now time.Time) int {
+	deleted := 0
+	for p := range lru.listEnd {
+		end := lru.listEnd[p]
+		for end != nil {
+			previous := end.previous
+			if end.expired(now) {
+				lru.delete(end)
+				deleted++
+			}
+			end = previous
+		}
+	}
+	return deleted
+}
+
+// fits Whether a node of nodeSize replacing n (nil if new) stays within the bucket
+// limits and the quota of its namespace ns (nil if none)
+func (lru *lrucache) fits(n *node, nodeSize uint64, ns *Namespace) bool {
+	size, items := lru.size+nodeSize, len(lru.keys)+1
+	if n != nil {
+		size -= n.size
+		items--
+	}
+	if size > lru.maxsize || (lru.maxItems > 0 && items > lru.maxItems) {
+		return false
+	}
+	if ns == nil || ns.bucketQuota == 0 {
+		return true
+	}
+	nsSize := lru.nsSizes[ns] + nodeSize
+	if n != nil && n.ns == ns {
+		nsSize -= n.size
+	}
+	return nsSize <= ns.bucketQuota
+}
+
 // worker Expiration worker
 //
-// Expriration Workers go from the bottom of the list to the top
+// Expriration Workers go from the bottom of each list to the top
 // And delete all elements that have expired.
 // Then they wait for the configured time before starting again.
 func (lru *lrucache) worker() {
 	for {
-		lru.mu.Lock()
-		end := lru.listEnd
-		lru.mu.Unlock()
+		for p := range lru.listEnd {
+			lru.mu.Lock()
+			end := lru.listEnd[p]
+			lru.mu.Unlock()
 
-		for end != nil {
-			if end.validTill.Before(time.Now()) {
+			for end != nil {
+				// Writes replace the expiration of nodes, check it under the lock
 				lru.mu.Lock()
-				if end != nil {
-					nend := end.previous
+				nend := end.previous
+				if end.expired(time.Now()) {
 					lru.delete(end)
-					end = nend
 				}
-				lru.mu.Unlock()
-			} else {
-				lru.mu.Lock()
-				end = end.previous
+				end = nend
 				lru.mu.Unlock()
 			}
 		}
 
+		lru.mu.Lock()
+		lru.deleteExpiredLeases(time.Now())
+		lru.mu.Unlock()
+
 		time.Sleep(lru.workerSleep)
 	}
 }
 
-// sendToTop promote node to top of list
+// sendToTop promote node to top of the list of its priority
 func (lru *lrucache) sendToTop(n *node) {
-	var listStart = lru.listStart
+	p := n.priority
+	var listStart = lru.listStart[p]
 	if listStart == nil {
-		lru.listStart = n
-		lru.listEnd = n
+		lru.listStart[p] = n
+		lru.listEnd[p] = n
 		return
 	}
 	if listStart == n {
@@ -172,91 +943,307 @@ func (lru *lrucache) sendToTop(n *node) {
 			n.next.previous = n.previous
 		}
 	}
-	if lru.listEnd == n {
-		lru.listEnd = n.previous
+	if lru.listEnd[p] == n {
+		lru.listEnd[p] = n.previous
 	}
 	n.next = listStart
 	n.previous = nil
 	listStart.previous = n
-	lru.listStart = n
+	lru.listStart[p] = n
 }
 
-// resize Resise list by size from the bottom
+// resize Resise list by size and number of items from the bottom
 func (lru *lrucache) resize() {
-	if lru.size > lru.maxsize {
-		// Shrink lisk
-		for lru.size > lru.maxsize {
-			end := lru.listEnd
-			lru.delete(end)
+	for {
+		overSize := lru.size > lru.maxsize
+		if !overSize && (lru.maxItems == 0 || len(lru.keys) <= lru.maxItems) {
+			return
+		}
+		end := lru.victim()
+		if end == nil {
+			return
 		}
+		if overSize {
+			atomic.AddUint64(&lru.numSizeEvictions, 1)
+		} else {
+			atomic.AddUint64(&lru.numItemsEvictions, 1)
+		}
+		atomic.AddUint64(&lru.priorityEvictions[end.priority], 1)
+		if lru.gdsf {
+			lru.gdsfClock = end.ext.gdsfValue
+		}
+		if lru.l2 != nil {
+			lru.demote(end, time.Now())
+		}
+		lru.delete(end)
 	}
 }
 
-// delete Delete node
-func (lru *lrucache) delete(n *node) {
+// victim Next node to be evicted to make room, nil if all are pinned
+func (lru *lrucache) victim() *node {
+	if lru.gdsf {
+		return lru.gdsfVictim()
+	}
+	// Bottom of the list of the lowest priority, skipping pinned nodes
+	for p := PriorityLow; p < numPriorities; p++ {
+		end := lru.listEnd[p]
+		for end != nil && end.pinned {
+			end = end.previous
+		}
+		if end != nil {
+			return end
+		}
+	}
+	return nil
+}
 
+// unlink Remove node from its list
+func (lru *lrucache) unlink(n *node) {
+	p := n.priority
 	if n.next != nil {
 		n.next.previous = n.previous
 	}
 	if n.previous != nil {
 		n.previous.next = n.next
 	}
-	if n == lru.listStart {
-		lru.listStart = n.next
+	if n == lru.listStart[p] {
+		lru.listStart[p] = n.next
 	}
-	if n == lru.listEnd {
-		lru.listEnd = n.previous
+	if n == lru.listEnd[p] {
+		lru.listEnd[p] = n.previous
 	}
 	n.previous = nil
 	n.next = nil
+}
+
+// delete Delete node
+func (lru *lrucache) delete(n *node) {
+
+	lru.unlink(n)
 
 	// Test if it's in the keys. (Function might have been called from worker after it has been deleted by another goroutine
 	// since worker does not lock the structure all the time. The following situation is pausible: A node is selected by worker
 	// in it's iterations, the lock is released, another routine locks and then deletes that node, then worker finds out the node
 	// has expired, locks and tries to delete it again, decrementing lru.size 2 times)
-	if _, ok := lru.keys[n.key]; ok {
+	// Compare the node too, the key might have been set again since.
+	if current, ok := lru.keys[n.key]; ok && current == n {
 		delete(lru.keys, n.key)
+		lru.gdsfRemove(n)
+		lru.releaseSlot(n)
+		lru.setTags(n, nil)
+		lru.unaccount(n)
+		if n.ns != nil {
+			atomic.AddUint64(&n.ns.numEvictions, 1)
+		}
 		atomic.AddUint64(&lru.size, ^uint64(n.size-1))
 		atomic.AddUint64(&lru.NumEvictions, 1)
 	}
 }
 
+// account Add a node to the usage of its namespace, priority and to the pinned size
+func (lru *lrucache) account(n *node) {
+	lru.prioritySizes[n.priority] += n.size
+	if n.pinned {
+		lru.pinnedSize += n.size
+	}
+	if n.ns == nil {
+		return
+	}
+	lru.nsSizes[n.ns] += n.size
+	atomic.AddUint64(&n.ns.size, n.size)
+	atomic.AddUint64(&n.ns.numObjects, 1)
+}
+
+// unaccount Remove a node from the usage of its namespace, priority and from the pinned size
+func (lru *lrucache) unaccount(n *node) {
+	lru.prioritySizes[n.priority] -= n.size
+	if n.pinned {
+		lru.pinnedSize -= n.size
+	}
+	if n.ns == nil {
+		return
+	}
+	lru.nsSizes[n.ns] -= n.size
+	if lru.nsSizes[n.ns] == 0 {
+		delete(lru.nsSizes, n.ns)
+	}
+	atomic.AddUint64(&n.ns.size, ^uint64(n.size-1))
+	atomic.AddUint64(&n.ns.numObjects, ^uint64(0))
+}
+
+// shrinkNamespace Evict the least recently used nodes of a namespace until it fits its quota
+//
+// current is the node being set, it is not evicted.
+func (lru *lrucache) shrinkNamespace(ns *Namespace, current *node) {
+	for p := PriorityLow; p < numPriorities; p++ {
+		end := lru.listEnd[p]
+		for end != nil && lru.nsSizes[ns] > ns.bucketQuota {
+			previous := end.previous
+			if end.ns == ns && end != current && !end.pinned {
+				lru.delete(end)
+			}
+			end = previous
+		}
+	}
+}
+
+// setTags Replace the tags of a node keeping the tag index up to date
+//
+// Nodes without a nodeExt have no tags.
+func (lru *lrucache) setTags(n *node, tags []string) {
+	if n.ext == nil {
+		return
+	}
+	for _, tag := range n.ext.tags {
+		nodes := lru.tags[tag]
+		delete(nodes, n)
+		if len(nodes) == 0 {
+			delete(lru.tags, tag)
+		}
+	}
+	n.ext.tags = nil
+	for _, tag := range tags {
+		nodes, ok := lru.tags[tag]
+		if !ok {
+			nodes = make(map[*node]struct{})
+			lru.tags[tag] = nodes
+		}
+		if _, ok = nodes[n]; !ok {
+			nodes[n] = struct{}{}
+			n.ext.tags = append(n.ext.tags, tag)
+		}
+	}
+}
+
+// tagsSize Size in bytes of the tags of a node and its entries on the tag index
+func (lru *lrucache) tagsSize(tags []string) uint64 {
+	size := uint64(0)
+	for _, tag := range tags {
+		size += uint64(len(tag)) + tagEntrySize
+	}
+	return size
+}
+
+// purgeTag purge all elements with a tag
+//
+// Returns the number of elements purged.
+func (lru *lrucache) purgeTag(tag string) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for n := range lru.tags[tag] {
+		lru.remove(n.key, n, now)
+		purged++
+	}
+	return purged
+}
+
+// keysByTag keys of the elements with a tag that have not expired
+func (lru *lrucache) keysByTag(tag string) []string {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for n := range lru.tags[tag] {
+		if !n.expired(now) {
+			keys = append(keys, n.key)
+		}
+	}
+	return keys
+}
+
+// takeSlot Assign a position in slots to a new node
+func (lru *lrucache) takeSlot(n *node) {
+	if last := len(lru.freeSlots) - 1; last >= 0 {
+		n.slot = lru.freeSlots[last]
+		lru.freeSlots = lru.freeSlots[:last]
+		lru.slots[n.slot] = n
+		return
+	}
+	n.slot = len(lru.slots)
+	lru.slots = append(lru.slots, n)
+}
+
+// releaseSlot Free the position in slots of a deleted node
+func (lru *lrucache) releaseSlot(n *node) {
+	lru.slots[n.slot] = nil
+	lru.freeSlots = append(lru.freeSlots, n.slot)
+}
+
+// scan Visit the elements on a range of slots
+//
+// Calls fn with the lock held for every element that has not expired in
+// slots [cursor, cursor + count). Returns the cursor to continue from and
+// whether there are slots left to visit.
+func (lru *lrucache) scan(cursor, count int, fn func(n *node, now time.Time)) (int, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := time.Now()
+	if cursor > len(lru.slots) {
+		cursor = len(lru.slots)
+	}
+	// Clamped before adding so that a big count doesn't overflow
+	if count > len(lru.slots)-cursor {
+		count = len(lru.slots) - cursor
+	}
+	end := cursor + count
+	for i := cursor; i < end; i++ {
+		if n := lru.slots[i]; n != nil && !n.expired(now) {
+			fn(n, now)
+		}
+	}
+	return end, end < len(lru.slots)
+}
+
 // calculateBaseNodeSize Calculate the Byte Size of a single Node
 func (lru *lrucache) calculateBaseNodeSize() uint64 {
 	n := new(node)
-	size := uint64(unsafe.Sizeof(n.key)) + uint64(unsafe.Sizeof(n.payload)) + uint64(unsafe.Sizeof(n.previous)) + uint64(unsafe.Sizeof(n.next)) + uint64(unsafe.Sizeof(n.size)) + uint64(unsafe.Sizeof(n.validTill))
+	size := uint64(unsafe.Sizeof(n.key)) + uint64(unsafe.Sizeof(n.payload)) + uint64(unsafe.Sizeof(n.previous)) + uint64(unsafe.Sizeof(n.next)) + uint64(unsafe.Sizeof(n.size)) + uint64(unsafe.Sizeof(n.validTill)) + uint64(unsafe.Sizeof(n.version)) + uint64(unsafe.Sizeof(n.slot)) + uint64(unsafe.Sizeof(n.ns)) + uint64(unsafe.Sizeof(n.pinned)) + uint64(unsafe.Sizeof(n.priority)) + uint64(unsafe.Sizeof(n.missing)) + uint64(unsafe.Sizeof(n.ext))
+	return size
+}
+
+// calculateNodeExtSize Calculate the Byte Size of the optional fields of a Node
+func (lru *lrucache) calculateNodeExtSize() uint64 {
+	e := new(nodeExt)
+	size := uint64(unsafe.Sizeof(e.idle)) + uint64(unsafe.Sizeof(e.deadline)) + uint64(unsafe.Sizeof(e.tags)) + uint64(unsafe.Sizeof(e.cost)) + uint64(unsafe.Sizeof(e.freq)) + uint64(unsafe.Sizeof(e.gdsfValue)) + uint64(unsafe.Sizeof(e.heapIndex)) + uint64(unsafe.Sizeof(e.staleAt)) + uint64(unsafe.Sizeof(e.recompute)) + uint64(unsafe.Sizeof(e.earlyClaimed))
 	return size
 }
 
 // verifyEndAndStart testing function
 //
 // For Concurrent tests.
-// Verifies that list is the same from listStart to listEnd
+// Verifies that every list is the same from listStart to listEnd
 func (lru *lrucache) verifyEndAndStart() error {
 
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
-	start := lru.listStart
+	for p := range lru.listStart {
+		start := lru.listStart[p]
 
-	if start != nil {
+		if start != nil {
 
-		// Get to last element of start
-		for start.next != nil {
-			start = start.next
-		}
+			// Get to last element of start
+			for start.next != nil {
+				start = start.next
+			}
 
-		end := lru.listEnd
+			end := lru.listEnd[p]
 
-		// Compare them
-		for start.previous != nil {
-			if end != start {
-				return errors.New("listStart does not match order of listEnd")
+			// Compare them
+			for start.previous != nil {
+				if end != start {
+					return errors.New("listStart does not match order of listEnd")
+				}
+				end = end.previous
+				start = start.previous
 			}
-			end = end.previous
-			start = start.previous
-		}
 
+		}
 	}
 
 	return nil
@@ -271,15 +1258,17 @@ func (lru *lrucache) verifyUniqueKeys() error {
 	defer lru.mu.Unlock()
 
 	test := make(map[string]bool)
-	start := lru.listStart
-	for start != nil {
-		_, ok := test[start.key]
-		if !ok {
-			test[start.key] = true
-		} else {
-			return errors.New("Duplicated Key in listStart")
+	for p := range lru.listStart {
+		start := lru.listStart[p]
+		for start != nil {
+			_, ok := test[start.key]
+			if !ok {
+				test[start.key] = true
+			} else {
+				return errors.New("Duplicated Key in listStart")
+			}
+			start = start.next
 		}
-		start = start.next
 	}
 	return nil
 }
@@ -293,18 +1282,21 @@ func (lru *lrucache) verifySize() error {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 
-	start := lru.listStart
 	realSize := uint64(0)
 	sumSize := uint64(0)
 
-	if start != nil {
+	for p := range lru.listStart {
+		start := lru.listStart[p]
 
 		// Get to last element of start
-		for start.next != nil {
+		for start != nil && start.next != nil {
 			realSize += uint64(len(start.key)) + uint64(len(start.payload)) + lru.calculateBaseNodeSize()
 			sumSize += start.size
 			start = start.next
 		}
+	}
+
+	if realSize > 0 {
 
 		// Compare them
 		if realSize > lru.maxsize {
@@ -319,3 +1311,27 @@ func (lru *lrucache) verifySize() error {
 
 	return nil
 }
+
+// verifySlots testing function
+//
+// For Concurrent tests.
+// Verifies that every key is on its slot and that there are no other nodes on slots
+func (lru *lrucache) verifySlots() error {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	numSlots := 0
+	for i, n := range lru.slots {
+		if n == nil {
+			continue
+		}
+		numSlots++
+		if n.slot != i || lru.keys[n.key] != n {
+			return fmt.Errorf("Node with key %v on slot %v is not on keys", n.key, i)
+		}
+	}
+	if numSlots != len(lru.keys) {
+		return fmt.Errorf("numSlots: %v != number of keys: %v", numSlots, len(lru.keys))
+	}
+	return nil
+}
@@ -2,13 +2,14 @@ package dscache
 
 import (
 	"math/rand"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 )
 
 func TestSize(t *testing.T) {
-	var lru = newLRUCache(100000, 0)
+	var lru = newLRUCache(100000, time.Minute)
 	if lru.size != 0 {
 		t.Error("lrucache.size not initialized in 0.")
 	}
@@ -46,8 +47,24 @@ func TestSize(t *testing.T) {
 	}
 }
 
+func TestSizeOfExistingElement(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	nodeSize := lru.calculateBaseNodeSize()
+
+	lru.set("a", "1234567890", time.Second*10)
+	lru.set("a", "123", time.Second*10)
+	if lru.size != nodeSize+4 {
+		t.Error("lrucache.size not subtracting correctly on smaller set.")
+	}
+
+	lru.set("a", "12345", time.Second*10)
+	if lru.size != nodeSize+6 {
+		t.Error("lrucache.size not adding correctly on bigger set.")
+	}
+}
+
 func TestSizeError(t *testing.T) {
-	var lru = newLRUCache(16, 0)
+	var lru = newLRUCache(16, time.Minute)
 	err := lru.set("a", "1234567890", time.Second*10) // 10 + 8
 	if err != ErrMaxsize {
 		t.Error("lrucache not returning an error when exceding size. Test 1")
@@ -55,7 +72,7 @@ func TestSizeError(t *testing.T) {
 }
 
 func TestBasicGetSet(t *testing.T) {
-	var lru = newLRUCache(100000, 0)
+	var lru = newLRUCache(100000, time.Minute)
 	lru.set("a", "a", time.Second*10)
 
 	tmp, _ := lru.get("a")
@@ -76,42 +93,42 @@ func TestBasicGetSet(t *testing.T) {
 }
 
 func TestLRUOrderInsert(t *testing.T) {
-	var lru = newLRUCache(100000, 0)
+	var lru = newLRUCache(100000, time.Minute)
 	lru.set("a", "a", time.Second*10)
 	lru.set("b", "b", time.Second*10)
 	lru.set("c", "c", time.Second*10)
 
-	var start = lru.listStart
+	var start = lru.listStart[PriorityNormal]
 	if start.payload != "c" || start.next.payload != "b" || start.next.next.payload != "a" || start.next.next.next != nil {
 		t.Error("LRU Order after inserts not correct. Test 1.")
 	}
 
-	var end = lru.listEnd
+	var end = lru.listEnd[PriorityNormal]
 	if end.payload != "a" || end.previous.payload != "b" || end.previous.previous.payload != "c" || end.previous.previous.previous != nil {
 		t.Error("LRU Order after inserts not correct. Test 2.")
 	}
 }
 
 func TestLRUOrderInsertPluSGet(t *testing.T) {
-	var lru = newLRUCache(100000, 0)
+	var lru = newLRUCache(100000, time.Minute)
 	lru.set("a", "a", time.Second*10)
 	lru.set("b", "b", time.Second*10)
 	lru.set("c", "c", time.Second*10)
 	lru.get("a")
 
-	var start = lru.listStart
+	var start = lru.listStart[PriorityNormal]
 	if start.payload != "a" || start.next.payload != "c" || start.next.next.payload != "b" || start.next.next.next != nil {
 		t.Error("LRU Order after inserts Plus get not correct. Test 1.")
 	}
 
-	var end = lru.listEnd
+	var end = lru.listEnd[PriorityNormal]
 	if end.payload != "b" || end.previous.payload != "c" || end.previous.previous.payload != "a" || end.previous.previous.previous != nil {
 		t.Error("LRU Order after inserts Plus get not correct. Test 2.")
 	}
 }
 
 func TestLRUOrderInsertPlusVariousGets(t *testing.T) {
-	var lru = newLRUCache(100000, 0)
+	var lru = newLRUCache(100000, time.Minute)
 	lru.set("a", "a", time.Second*10)
 	lru.set("b", "b", time.Second*10)
 	lru.set("c", "c", time.Second*10)
@@ -119,41 +136,41 @@ func TestLRUOrderInsertPlusVariousGets(t *testing.T) {
 	lru.get("b")
 	lru.get("a")
 
-	var start = lru.listStart
+	var start = lru.listStart[PriorityNormal]
 	if start.payload != "a" || start.next.payload != "b" || start.next.next.payload != "c" || start.next.next.next != nil {
 		t.Error("LRU Order after inserts Plus various gets not correct. Test 1.")
 	}
 
-	var end = lru.listEnd
+	var end = lru.listEnd[PriorityNormal]
 	if end.payload != "c" || end.previous.payload != "b" || end.previous.previous.payload != "a" || end.previous.previous.previous != nil {
 		t.Error("LRU Order after inserts Plus various gets not correct. Test 2.")
 	}
 
 	lru.get("a")
-	start = lru.listStart
+	start = lru.listStart[PriorityNormal]
 	if start.payload != "a" || start.next.payload != "b" || start.next.next.payload != "c" || start.next.next.next != nil {
 		t.Error("LRU Order after inserts Plus various gets not correct. Test 3.")
 	}
 
-	end = lru.listEnd
+	end = lru.listEnd[PriorityNormal]
 	if end.payload != "c" || end.previous.payload != "b" || end.previous.previous.payload != "a" || end.previous.previous.previous != nil {
 		t.Error("LRU Order after inserts Plus various gets not correct. Test 4.")
 	}
 
 	lru.get("c")
-	start = lru.listStart
+	start = lru.listStart[PriorityNormal]
 	if start.payload != "c" || start.next.payload != "a" || start.next.next.payload != "b" || start.next.next.next != nil {
 		t.Error("LRU Order after inserts Plus various gets not correct. Test 5.")
 	}
 
-	end = lru.listEnd
+	end = lru.listEnd[PriorityNormal]
 	if end.payload != "b" || end.previous.payload != "a" || end.previous.previous.payload != "c" || end.previous.previous.previous != nil {
 		t.Error("LRU Order after inserts Plus Various gets not correct. Test 2.")
 	}
 }
 
 func TestMaxsize(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -162,32 +179,32 @@ func TestMaxsize(t *testing.T) {
 	lru.set("c", "abc", time.Second*10) // 4
 	lru.set("d", "abc", time.Second*10) // 4
 
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.key != "d" || start.next.key != "c" || start.next.next.key != "b" || start.next.next.next.key != "a" {
 		t.Error("Maxsize. Test 1.a")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.key != "a" || end.previous.key != "b" || end.previous.previous.key != "c" || end.previous.previous.previous.key != "d" {
 		t.Error("Maxsize. Test 1.b.")
 	}
 
 	// Now must delete
 	lru.set("e", "abc", time.Second*10)
-	start = lru.listStart
+	start = lru.listStart[PriorityNormal]
 	if start.key != "e" || start.next.key != "d" || start.next.next.key != "c" || start.next.next.next.key != "b" || start.next.next.next.next != nil {
 		t.Error("Maxsize. Test 2.a")
 	}
-	end = lru.listEnd
+	end = lru.listEnd[PriorityNormal]
 	if end.key != "b" || end.previous.key != "c" || end.previous.previous.key != "d" || end.previous.previous.previous.key != "e" || end.previous.previous.previous.previous != nil {
 		t.Error("Maxsize. Test 2.b.")
 	}
 
 	lru.set("f", "abc", time.Second*10)
-	start = lru.listStart
+	start = lru.listStart[PriorityNormal]
 	if start.key != "f" || start.next.key != "e" || start.next.next.key != "d" || start.next.next.next.key != "c" || start.next.next.next.next != nil {
 		t.Error("Maxsize. Test 2.a")
 	}
-	end = lru.listEnd
+	end = lru.listEnd[PriorityNormal]
 	if end.key != "c" || end.previous.key != "d" || end.previous.previous.key != "e" || end.previous.previous.previous.key != "f" || end.previous.previous.previous.previous != nil {
 		t.Error("Maxsize. Test 2.b.")
 	}
@@ -195,7 +212,7 @@ func TestMaxsize(t *testing.T) {
 }
 
 func TestLRUOrderExhaustiveTest0(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -205,18 +222,18 @@ func TestLRUOrderExhaustiveTest0(t *testing.T) {
 	lru.set("a", "aaa", time.Second*10) // 4 + 8
 
 	// Currently it's a->b->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "c" || start.next.next.next.key != "d" || start.next.next.next.next != nil {
 		t.Error("LRU Order Exhaustive Test. Test 0. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "b" || end.previous.previous.previous.key != "a" || end.previous.previous.previous.previous != nil {
 		t.Error("LRU Order Exhaustive Test. Test 0. Incorrect ListEnd.")
 	}
 }
 
 func TestLRUOrderExhaustiveTest1(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -232,18 +249,18 @@ func TestLRUOrderExhaustiveTest1(t *testing.T) {
 	}
 
 	// Now it's a->b->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "c" || start.next.next.next.key != "d" || start.next.next.next.next != nil {
 		t.Error("LRU Order Exhaustive Test. Test 1. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "b" || end.previous.previous.previous.key != "a" || end.previous.previous.previous.previous != nil {
 		t.Error("LRU Order Exhaustive Test. Test 1. Incorrect ListEnd.")
 	}
 }
 
 func TestLRUOrderExhaustiveTest2(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -259,18 +276,18 @@ func TestLRUOrderExhaustiveTest2(t *testing.T) {
 	}
 
 	// Now it's b->a->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "b" || start.next.key != "a" || start.next.next.key != "c" || start.next.next.next.key != "d" || start.next.next.next.next != nil {
 		t.Error("LRU Order Exhaustive Test. Test 2. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "a" || end.previous.previous.previous.key != "b" || end.previous.previous.previous.previous != nil {
 		t.Error("LRU Order Exhaustive Test. Test 2. Incorrect ListEnd.")
 	}
 }
 
 func TestLRUOrderExhaustiveTest3(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -286,18 +303,18 @@ func TestLRUOrderExhaustiveTest3(t *testing.T) {
 	}
 
 	// Now it's c->a->b->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "c" || start.next.key != "a" || start.next.next.key != "b" || start.next.next.next.key != "d" || start.next.next.next.next != nil {
 		t.Error("LRU Order Exhaustive Test. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous.key != "c" || end.previous.previous.previous.previous != nil {
 		t.Error("LRU Order Exhaustive Test. Test 3. Incorrect ListEnd.")
 	}
 }
 
 func TestLRUOrderExhaustiveTest4(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -313,18 +330,18 @@ func TestLRUOrderExhaustiveTest4(t *testing.T) {
 	}
 
 	// Now it's d->a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "d" || start.next.key != "a" || start.next.next.key != "b" || start.next.next.next.key != "c" || start.next.next.next.next != nil {
 		t.Error("LRU Order Exhaustive Test. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "c" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous.key != "d" || end.previous.previous.previous.previous != nil {
 		t.Error("LRU Order Exhaustive Test. Test 3. Incorrect ListEnd.")
 	}
 }
 
 func TestSetOfExistingElement(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -341,11 +358,11 @@ func TestSetOfExistingElement(t *testing.T) {
 	}
 
 	// Now it's d->a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "d" || start.next.key != "a" || start.next.next.key != "b" || start.next.next.next.key != "c" || start.next.next.next.next != nil {
 		t.Error("Set of existing element. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "c" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous.key != "d" || end.previous.previous.previous.previous != nil {
 		t.Error("Set of existing element. Test 3. Incorrect ListEnd.")
 	}
@@ -353,7 +370,7 @@ func TestSetOfExistingElement(t *testing.T) {
 }
 
 func TestMaxsizeVariousSetsIncludingResets(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -368,11 +385,11 @@ func TestMaxsizeVariousSetsIncludingResets(t *testing.T) {
 	lru.set("d", "ddd", time.Second*10)
 	lru.set("g", "ggg", time.Second*10)
 
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "g" || start.next.key != "d" || start.next.next.key != "f" || start.next.next.next.key != "e" || start.next.next.next.next != nil {
 		t.Error("Maxsize Various Sets Including Resets. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "e" || end.previous.key != "f" || end.previous.previous.key != "d" || end.previous.previous.previous.key != "g" || end.previous.previous.previous.previous != nil {
 		t.Error("Maxsize Various Sets Including Resets. Incorrect ListEnd.")
 	}
@@ -380,7 +397,7 @@ func TestMaxsizeVariousSetsIncludingResets(t *testing.T) {
 }
 
 func TestPurgeExhaustiveTest1(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -393,18 +410,18 @@ func TestPurgeExhaustiveTest1(t *testing.T) {
 	lru.purge("a")
 
 	// Now it's b->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "b" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("purge Exhaustive Test. Test 1. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "b" || end.previous.previous.previous != nil {
 		t.Error("purge Exhaustive Test. Test 1. Incorrect ListEnd.")
 	}
 }
 
 func TestPurgeExhaustiveTest2(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -417,18 +434,18 @@ func TestPurgeExhaustiveTest2(t *testing.T) {
 	lru.purge("b")
 
 	// Now it's a->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("purge Exhaustive Test. Test 2. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("purge Exhaustive Test. Test 2. Incorrect ListEnd.")
 	}
 }
 
 func TestPurgeExhaustiveTest3(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -441,18 +458,18 @@ func TestPurgeExhaustiveTest3(t *testing.T) {
 	lru.purge("c")
 
 	// Now it's a->b->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("purge Exhaustive Test. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("purge Exhaustive Test. Test 3. Incorrect ListEnd.")
 	}
 }
 
 func TestPurgeExhaustiveTest4(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -465,18 +482,18 @@ func TestPurgeExhaustiveTest4(t *testing.T) {
 	lru.purge("d")
 
 	// Now it's a->b->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "c" || start.next.next.next != nil {
 		t.Error("purge Exhaustive Test. Test 4. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "c" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("purge Exhaustive Test. Test 4. Incorrect ListEnd.")
 	}
 }
 
 func TestExpireExhaustiveTest1(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -494,11 +511,11 @@ func TestExpireExhaustiveTest1(t *testing.T) {
 	}
 
 	// Should be a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "c" || start.next.next.next != nil {
 		t.Error("Expire Exhaustive Test. Test 1. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "c" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Expire Exhaustive Test. Test 1. Incorrect ListEnd.")
 	}
@@ -506,7 +523,7 @@ func TestExpireExhaustiveTest1(t *testing.T) {
 }
 
 func TestExpireExhaustiveTest2(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -524,18 +541,18 @@ func TestExpireExhaustiveTest2(t *testing.T) {
 	}
 
 	// Should be a->b->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Expire Exhaustive Test. Test 2. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Expire Exhaustive Test. Test 2. Incorrect ListEnd.")
 	}
 }
 
 func TestExpireExhaustiveTest3(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -553,18 +570,18 @@ func TestExpireExhaustiveTest3(t *testing.T) {
 	}
 
 	// Should be a->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Expire Exhaustive Test. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Expire Exhaustive Test. Test 3. Incorrect ListEnd.")
 	}
 }
 
 func TestExpireExhaustiveTest4(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Minute)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -582,18 +599,18 @@ func TestExpireExhaustiveTest4(t *testing.T) {
 	}
 
 	// Should be b->c->d
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "b" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Expire Exhaustive Test. Test 4. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "b" || end.previous.previous.previous != nil {
 		t.Error("Expire Exhaustive Test. Test 4. Incorrect ListEnd.")
 	}
 }
 
 func TestWorkerExhaustive1(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Second/10)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -611,11 +628,11 @@ func TestWorkerExhaustive1(t *testing.T) {
 	}
 
 	// Should be a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "c" || start.next.next.next != nil {
 		t.Error("Worker Test. Test 1. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "c" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Worker Test. Test 1. Incorrect ListEnd.")
 	}
@@ -623,7 +640,7 @@ func TestWorkerExhaustive1(t *testing.T) {
 }
 
 func TestWorkerExhaustive2(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Second/10)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -641,11 +658,11 @@ func TestWorkerExhaustive2(t *testing.T) {
 	}
 
 	// Should be a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "b" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Worker Test. Test 2. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "b" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Worker Test. Test 2. Incorrect ListEnd.")
 	}
@@ -653,7 +670,7 @@ func TestWorkerExhaustive2(t *testing.T) {
 }
 
 func TestWorkerExhaustive3(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Second/10)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -671,11 +688,11 @@ func TestWorkerExhaustive3(t *testing.T) {
 	}
 
 	// Should be a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "a" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Worker Test. Test 3. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "a" || end.previous.previous.previous != nil {
 		t.Error("Worker Test. Test 3. Incorrect ListEnd.")
 	}
@@ -683,7 +700,7 @@ func TestWorkerExhaustive3(t *testing.T) {
 }
 
 func TestWorkerExhaustive4(t *testing.T) {
-	var lru = newLRUCache(48, 0)
+	var lru = newLRUCache(48, time.Second/10)
 	nodeSize := lru.calculateBaseNodeSize()
 	lru.maxsize = (nodeSize + 4) * 4
 
@@ -701,17 +718,605 @@ func TestWorkerExhaustive4(t *testing.T) {
 	}
 
 	// Should be a->b->c
-	start := lru.listStart
+	start := lru.listStart[PriorityNormal]
 	if start.previous != nil || start.key != "b" || start.next.key != "c" || start.next.next.key != "d" || start.next.next.next != nil {
 		t.Error("Worker Test. Test 4. Incorrect ListStart.")
 	}
-	end := lru.listEnd
+	end := lru.listEnd[PriorityNormal]
 	if end.next != nil || end.key != "d" || end.previous.key != "c" || end.previous.previous.key != "b" || end.previous.previous.previous != nil {
 		t.Error("Worker Test. Test 4. Incorrect ListEnd.")
 	}
 
 }
 
+func TestPeek(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "aaa", time.Second*10)
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second/5)
+
+	payload, ttl, ok := lru.peek("a")
+	if !ok || payload != "aaa" || ttl <= 0 || ttl > time.Second*10 {
+		t.Error("Peek. Test 1. Incorrect payload or ttl.")
+	}
+
+	// Peek must not promote, it's still b->a
+	start := lru.listStart[PriorityNormal]
+	if start.key != "c" || start.next.key != "b" || start.next.next.key != "a" {
+		t.Error("Peek. Test 2. Peek changed LRU order.")
+	}
+
+	if !lru.has("b") || lru.has("z") {
+		t.Error("Peek. Test 3. Incorrect has.")
+	}
+
+	time.Sleep(time.Second / 2)
+	if _, _, ok = lru.peek("c"); ok {
+		t.Error("Peek. Test 4. Expired element returned.")
+	}
+	if lru.has("c") {
+		t.Error("Peek. Test 5. Expired element reported.")
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "aaa", time.Second/5)
+	lru.set("b", "bbb", time.Second/5)
+	lru.set("c", "ccc", time.Second*10)
+
+	if !lru.expireAt("a", time.Now().Add(time.Second*10)) {
+		t.Error("ExpireAt. Test 1. Element not found.")
+	}
+	if !lru.expireAt("b", time.Time{}) {
+		t.Error("ExpireAt. Test 2. Element not found.")
+	}
+	if ttl, ok := lru.ttl("b"); !ok || ttl != NoExpiration {
+		t.Error("ExpireAt. Test 3. Persisted element has an expiration.")
+	}
+	if lru.expireAt("z", time.Time{}) {
+		t.Error("ExpireAt. Test 4. Non existing element found.")
+	}
+
+	time.Sleep(time.Second / 2)
+	if _, ok := lru.get("a"); !ok {
+		t.Error("ExpireAt. Test 5. Extended element expired.")
+	}
+	if _, ok := lru.get("b"); !ok {
+		t.Error("ExpireAt. Test 6. Persisted element expired.")
+	}
+}
+
+func TestGetAndTouch(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "aaa", time.Second/5)
+	lru.set("b", "bbb", time.Second*10)
+
+	payload, ok := lru.getAndTouch("a", time.Second*10)
+	if !ok || payload != "aaa" {
+		t.Error("GetAndTouch. Test 1. Incorrect payload.")
+	}
+	if lru.listStart[PriorityNormal].key != "a" {
+		t.Error("GetAndTouch. Test 2. Element not promoted.")
+	}
+
+	time.Sleep(time.Second / 2)
+	if _, ok = lru.get("a"); !ok {
+		t.Error("GetAndTouch. Test 3. Touched element expired.")
+	}
+}
+
+func TestSliding(t *testing.T) {
+	var lru = newLRUCache(100000, time.Second/10)
+	lru.setSliding("a", "aaa", time.Second, 0)
+	lru.setSliding("b", "bbb", time.Second, 0)
+	lru.setSliding("c", "ccc", time.Second, time.Second*3/2)
+
+	// Keep a and c alive, let b go idle
+	for i := 0; i < 8; i++ {
+		time.Sleep(time.Second / 4)
+		lru.get("a")
+		lru.get("c")
+	}
+
+	if _, ok := lru.get("a"); !ok {
+		t.Error("Sliding. Test 1. Requested element expired.")
+	}
+	if _, ok := lru.get("b"); ok {
+		t.Error("Sliding. Test 2. Idle element did not expire.")
+	}
+	if _, ok := lru.get("c"); ok {
+		t.Error("Sliding. Test 3. Element lived past its max lifetime.")
+	}
+}
+
+func TestWorkerSliding(t *testing.T) {
+	var lru = newLRUCache(100000, time.Second/10)
+	lru.setSliding("a", "aaa", time.Second/5, 0)
+	lru.setSliding("b", "bbb", time.Second*10, time.Second/5)
+
+	time.Sleep(time.Second)
+
+	lru.mu.Lock()
+	numKeys := len(lru.keys)
+	lru.mu.Unlock()
+	if numKeys != 0 {
+		t.Error("Worker Sliding. Expired elements not deleted by worker.")
+	}
+}
+
+func TestWorkerConcurrentWrites(t *testing.T) {
+	// Run with -race, the worker checks nodes that are being rewritten
+	var lru = newLRUCache(100000, time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20000; j++ {
+				key := strconv.Itoa(j % 10)
+				switch (i + j) % 4 {
+				case 0:
+					lru.set(key, "tagged", time.Second, WithTags("t"))
+				case 1:
+					lru.set(key, "plain", time.Second)
+				case 2:
+					lru.setSliding(key, "sliding", time.Second, 0)
+				default:
+					lru.getAndTouch(key, time.Second)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConditionalWrites(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+
+	if err := lru.add("a", "aaa", time.Second*10); err != nil {
+		t.Error("Conditional Writes. Test 1. Add of absent element failed.")
+	}
+	if err := lru.add("a", "new", time.Second*10); err != ErrKeyExists {
+		t.Error("Conditional Writes. Test 2. Add of existing element did not fail.")
+	}
+	if err := lru.replace("b", "bbb", time.Second*10); err != ErrNotFound {
+		t.Error("Conditional Writes. Test 3. Replace of absent element did not fail.")
+	}
+	if err := lru.replace("a", "new", time.Second*10); err != nil {
+		t.Error("Conditional Writes. Test 4. Replace of existing element failed.")
+	}
+	if tmp, _ := lru.get("a"); tmp != "new" {
+		t.Error("Conditional Writes. Test 5. Incorrect payload.")
+	}
+
+	lru.set("c", "ccc", time.Second/5)
+	time.Sleep(time.Second / 2)
+	if err := lru.add("c", "new", time.Second*10); err != nil {
+		t.Error("Conditional Writes. Test 6. Add over expired element failed.")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "aaa", time.Second*10)
+
+	_, version, ok := lru.getWithVersion("a")
+	if !ok || version == 0 {
+		t.Error("Compare and Swap. Test 1. Incorrect version.")
+	}
+
+	if err := lru.compareAndSwap("a", version, "new", time.Second*10); err != nil {
+		t.Error("Compare and Swap. Test 2. Swap with current version failed.")
+	}
+	if err := lru.compareAndSwap("a", version, "old", time.Second*10); err != ErrVersionMismatch {
+		t.Error("Compare and Swap. Test 3. Swap with stale version did not fail.")
+	}
+	if err := lru.compareAndSwap("b", version, "bbb", time.Second*10); err != ErrNotFound {
+		t.Error("Compare and Swap. Test 4. Swap of absent element did not fail.")
+	}
+
+	payload, newVersion, _ := lru.getWithVersion("a")
+	if payload != "new" || newVersion <= version {
+		t.Error("Compare and Swap. Test 5. Incorrect payload or version.")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	nodeSize := lru.calculateBaseNodeSize()
+
+	var appendB = func(old string, exists bool) (string, time.Duration, bool) {
+		return old + "b", time.Second * 10, true
+	}
+	lru.compute("a", appendB)
+	lru.compute("a", appendB)
+
+	if tmp, _ := lru.get("a"); tmp != "bb" {
+		t.Error("Compute. Test 1. Incorrect payload.")
+	}
+	if lru.size != nodeSize+3 {
+		t.Error("Compute. Test 2. Incorrect size.")
+	}
+
+	lru.compute("a", func(old string, exists bool) (string, time.Duration, bool) {
+		return "", 0, false
+	})
+	if _, ok := lru.get("a"); ok || lru.size != 0 {
+		t.Error("Compute. Test 3. Element not purged.")
+	}
+}
+
+func TestIncr(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "10", time.Second/2)
+	lru.set("b", "abc", time.Second*10)
+
+	if value, err := lru.incr("a", 5); err != nil || value != 15 {
+		t.Error("Incr. Test 1. Incorrect value.")
+	}
+	if value, err := lru.incr("a", -20); err != nil || value != -5 {
+		t.Error("Incr. Test 2. Incorrect value.")
+	}
+	if _, err := lru.incr("b", 1); err != ErrNotNumeric {
+		t.Error("Incr. Test 3. Non numeric element incremented.")
+	}
+	if _, err := lru.incr("c", 1); err != ErrNotFound {
+		t.Error("Incr. Test 4. Absent element incremented.")
+	}
+
+	// Expiration is kept
+	time.Sleep(time.Second)
+	if _, err := lru.incr("a", 1); err != ErrNotFound {
+		t.Error("Incr. Test 5. Expiration not kept.")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	nodeSize := lru.calculateBaseNodeSize()
+
+	errs := make(map[string]error)
+	lru.setMulti([]Item{{"a", "aaa", time.Second * 10}, {"b", "bbb", time.Second * 10}, {"c", "ccc", time.Second * 10}}, errs)
+	if len(errs) != 0 || lru.size != (nodeSize+4)*3 {
+		t.Error("Multi. Test 1. Incorrect setMulti.")
+	}
+
+	result := make(map[string]string)
+	found := lru.getMulti([]string{"a", "c", "d"}, result)
+	if found != 2 || result["a"] != "aaa" || result["c"] != "ccc" {
+		t.Error("Multi. Test 2. Incorrect getMulti.")
+	}
+
+	// Now it's c->a->b
+	start := lru.listStart[PriorityNormal]
+	if start.key != "c" || start.next.key != "a" || start.next.next.key != "b" {
+		t.Error("Multi. Test 3. getMulti did not promote.")
+	}
+
+	if purged := lru.purgeMulti([]string{"a", "b", "d"}); purged != 2 || lru.size != nodeSize+4 {
+		t.Error("Multi. Test 4. Incorrect purgeMulti.")
+	}
+}
+
+func TestTags(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	nodeSize := lru.calculateBaseNodeSize()
+
+	lru.set("a", "aaa", time.Second*10, WithTags("x", "y"))
+	lru.set("b", "bbb", time.Second*10, WithTags("x"))
+	lru.set("c", "ccc", time.Second*10)
+
+	extSize := lru.calculateNodeExtSize()
+	if lru.size != (nodeSize+4)*3+2*extSize+2*(1+tagEntrySize)+(1+tagEntrySize) {
+		t.Error("Tags. Test 1. Tags not counted on size.")
+	}
+	if len(lru.tags["x"]) != 2 || len(lru.tags["y"]) != 1 {
+		t.Error("Tags. Test 2. Incorrect tag index.")
+	}
+
+	// Overwrite replaces tags
+	lru.set("a", "aaa", time.Second*10, WithTags("z"))
+	if len(lru.tags["x"]) != 1 || len(lru.tags["y"]) != 0 || len(lru.tags["z"]) != 1 {
+		t.Error("Tags. Test 3. Overwrite did not replace tags.")
+	}
+
+	// Purge removes them
+	lru.purge("b")
+	if _, ok := lru.tags["x"]; ok {
+		t.Error("Tags. Test 4. Purge did not remove tags.")
+	}
+
+	if purged := lru.purgeTag("z"); purged != 1 || len(lru.keys) != 1 || len(lru.tags) != 0 {
+		t.Error("Tags. Test 5. Incorrect purgeTag.")
+	}
+	if lru.size != nodeSize+4 {
+		t.Error("Tags. Test 6. Incorrect size after purgeTag.")
+	}
+	if lru.keys["c"].ext != nil {
+		t.Error("Tags. Test 7. Element without tags got optional fields.")
+	}
+
+	// Overwriting without tags drops them with the optional fields
+	lru.set("d", "ddd", time.Second*10, WithTags("w"))
+	lru.set("d", "ddd", time.Second*10)
+	if lru.keys["d"].ext != nil || len(lru.tags) != 0 || lru.size != (nodeSize+4)*2 {
+		t.Error("Tags. Test 8. Overwrite without tags kept them.")
+	}
+}
+
+func TestTagsEviction(t *testing.T) {
+	var lru = newLRUCache(48, time.Minute)
+	nodeSize := lru.calculateBaseNodeSize()
+	lru.maxsize = (nodeSize + lru.calculateNodeExtSize() + 4 + 1 + tagEntrySize) * 2
+
+	lru.set("a", "aaa", time.Second*10, WithTags("t"))
+	lru.set("b", "bbb", time.Second*10, WithTags("t"))
+	lru.set("c", "ccc", time.Second*10, WithTags("t"))
+
+	// a was evicted
+	if len(lru.tags["t"]) != 2 || len(lru.keysByTag("t")) != 2 {
+		t.Error("Tags Eviction. Evicted element still on tag index.")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.set("a", "aaa", time.Second*10, WithTags("t"))
+	lru.set("b", "bbb", time.Second*10)
+
+	lru.flush()
+	if len(lru.keys) != 0 || len(lru.tags) != 0 || lru.size != 0 || lru.listStart[PriorityNormal] != nil || lru.listEnd[PriorityNormal] != nil {
+		t.Error("Flush. Test 1. Not empty.")
+	}
+
+	// Still usable
+	lru.set("a", "aaa", time.Second*10)
+	if tmp, _ := lru.get("a"); tmp != "aaa" || lru.verifySlots() != nil {
+		t.Error("Flush. Test 2. Not usable after flush.")
+	}
+}
+
+func TestFlushExpired(t *testing.T) {
+	var lru = newLRUCache(100000, time.Hour)
+	nodeSize := lru.calculateBaseNodeSize()
+	lru.set("a", "aaa", time.Second/5)
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second/5)
+
+	time.Sleep(time.Second / 2)
+	if deleted := lru.flushExpired(); deleted != 2 {
+		t.Error("Flush Expired. Test 1. Incorrect number of deleted elements.")
+	}
+	if len(lru.keys) != 1 || lru.size != nodeSize+4 || lru.listStart[PriorityNormal] != lru.listEnd[PriorityNormal] {
+		t.Error("Flush Expired. Test 2. Incorrect state.")
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.maxItems = 3
+
+	lru.set("a", "aaa", time.Second*10)
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second*10)
+	lru.get("a")
+	lru.set("d", "ddd", time.Second*10)
+
+	// Now it's d->a->c
+	start := lru.listStart[PriorityNormal]
+	if len(lru.keys) != 3 || start.key != "d" || start.next.key != "a" || start.next.next.key != "c" || start.next.next.next != nil {
+		t.Error("Max Items. Test 1. Incorrect eviction.")
+	}
+	if lru.numItemsEvictions != 1 || lru.numSizeEvictions != 0 {
+		t.Error("Max Items. Test 2. Incorrect eviction stats.")
+	}
+
+	lru.maxsize = lru.size
+	lru.set("e", "eeeeeeeeee", time.Second*10)
+	if lru.numSizeEvictions == 0 || lru.numItemsEvictions != 1 {
+		t.Error("Max Items. Test 3. Incorrect eviction stats.")
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.maxItems = 2
+	lru.noEvict = true
+
+	lru.set("a", "aaa", time.Second*10)
+	lru.set("b", "bbb", time.Second*10)
+	if err := lru.set("c", "ccc", time.Second*10); err != ErrCacheFull {
+		t.Error("No Eviction. Test 1. Should return ErrCacheFull.")
+	}
+	if len(lru.keys) != 2 || lru.NumEvictions != 0 || lru.numRejectedWrites != 1 {
+		t.Error("No Eviction. Test 2. Nothing should have been evicted.")
+	}
+
+	// Overwriting an existing element fits
+	if err := lru.set("a", "aaaa", time.Second*10); err != nil {
+		t.Error("No Eviction. Test 3. Overwrite should be allowed.")
+	}
+
+	// Expired elements are reclaimed
+	lru.set("b", "bbb", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	if err := lru.set("c", "ccc", time.Second*10); err != nil {
+		t.Error("No Eviction. Test 4. Expired element should have been reclaimed.")
+	}
+	if _, ok := lru.keys["b"]; ok || len(lru.keys) != 2 {
+		t.Error("No Eviction. Test 5. Incorrect elements.")
+	}
+
+	// Size limit
+	lru.maxItems = 0
+	lru.maxsize = lru.size + lru.nodeBaseSize + 2
+	if err := lru.set("d", "ddd", time.Second*10); err != ErrCacheFull {
+		t.Error("No Eviction. Test 6. Should return ErrCacheFull.")
+	}
+	if err := lru.set("d", "d", time.Second*10); err != nil {
+		t.Error("No Eviction. Test 7. Element should fit.")
+	}
+	if lru.numRejectedWrites != 2 || lru.NumEvictions != 1 {
+		t.Error("No Eviction. Test 8. Incorrect stats.")
+	}
+	if err := lru.verifySlots(); err != nil {
+		t.Error("No Eviction. Test 9. ", err)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.maxItems = 3
+
+	lru.setPinned("a", "aaa", time.Second*10)
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second*10)
+	lru.set("d", "ddd", time.Second*10)
+
+	// a is the least recently used but pinned, b is evicted instead
+	if _, ok := lru.keys["a"]; !ok {
+		t.Error("Pinned. Test 1. Pinned element should not be evicted.")
+	}
+	if _, ok := lru.keys["b"]; ok {
+		t.Error("Pinned. Test 2. Least recently used unpinned element should be evicted.")
+	}
+	if lru.pinnedSize != lru.keys["a"].size {
+		t.Error("Pinned. Test 3. Incorrect pinned size.")
+	}
+
+	// Pinned elements can be purged
+	lru.purge("a")
+	if _, ok := lru.keys["a"]; ok || lru.pinnedSize != 0 {
+		t.Error("Pinned. Test 4. Pinned element should be purged.")
+	}
+
+	// Overwriting with set unpins
+	lru.setPinned("c", "ccc", time.Second*10)
+	lru.set("c", "cccc", time.Second*10)
+	if lru.keys["c"].pinned || lru.pinnedSize != 0 {
+		t.Error("Pinned. Test 5. Element should be unpinned.")
+	}
+
+	// Pin limit
+	lru.maxPinned = lru.nodeBaseSize*2 + 8
+	if err := lru.setPinned("e", "eee", time.Second*10); err != nil {
+		t.Error("Pinned. Test 6. Should be pinned.")
+	}
+	if err := lru.setPinned("f", "fffffff", time.Second*10); err != ErrPinLimit {
+		t.Error("Pinned. Test 7. Should return ErrPinLimit.")
+	}
+	if err := lru.setPinned("e", "eeeeee", time.Second*10); err != nil {
+		t.Error("Pinned. Test 8. Repinning should only count the difference.")
+	}
+	if _, ok := lru.keys["f"]; ok || lru.pinnedSize != lru.keys["e"].size {
+		t.Error("Pinned. Test 9. Incorrect pinned size.")
+	}
+
+	// A fully pinned bucket stops evicting
+	lru.maxPinned = lru.maxsize
+	lru.maxItems = 1
+	lru.setPinned("g", "ggg", time.Second*10)
+	if len(lru.keys) != 2 {
+		t.Error("Pinned. Test 10. Only unpinned elements should be evicted.")
+	}
+	if err := lru.verifySlots(); err != nil {
+		t.Error("Pinned. Test 11. ", err)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.maxItemSize = lru.nodeBaseSize + 10
+	lru.doorkeeper = newDoorkeeper(100)
+
+	if err := lru.set("a", "aaa", time.Second*10); err != ErrNotAdmitted {
+		t.Error("Admission. Test 1. First set should not be admitted.")
+	}
+	if err := lru.set("a", "aaa", time.Second*10); err != nil {
+		t.Error("Admission. Test 2. Second set should be admitted.")
+	}
+	if err := lru.set("a", "aaaa", time.Second*10); err != nil {
+		t.Error("Admission. Test 3. Overwrite should be admitted.")
+	}
+	if err := lru.set("a", "aaaaaaaaaaaaaa", time.Second*10); err != ErrNotAdmitted {
+		t.Error("Admission. Test 4. Oversized element should not be admitted.")
+	}
+	if err := lru.setPinned("b", "bbb", time.Second*10); err != nil {
+		t.Error("Admission. Test 5. Pinned element should be admitted.")
+	}
+	if payload, _ := lru.get("a"); payload != "aaaa" || len(lru.keys) != 2 {
+		t.Error("Admission. Test 6. Incorrect elements.")
+	}
+	if lru.numDoorkeeperRejections != 1 || lru.numSizeRejections != 1 {
+		t.Error("Admission. Test 7. Incorrect rejections.")
+	}
+	if err := lru.set("c", "ccc", time.Second*10, WithoutDoorkeeper()); err != nil || !lru.has("c") {
+		t.Error("Admission. Test 8. Set without the doorkeeper should be admitted.")
+	}
+}
+
+func TestXFetch(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.xfetchBeta = 1
+
+	// Recomputing takes far longer than what it has left
+	lru.set("a", "aaa", time.Second*10, WithRecomputeTime(time.Hour*100))
+	if _, ok := lru.get("a"); ok {
+		t.Error("XFetch. Test 1. Should expire early.")
+	}
+	if _, ok := lru.get("a"); !ok {
+		t.Error("XFetch. Test 2. Only one get should miss.")
+	}
+	if lru.numEarlyExpirations != 1 {
+		t.Error("XFetch. Test 3. Incorrect early expirations.")
+	}
+
+	// Setting it again allows another early miss
+	lru.set("a", "aaa", time.Second*10, WithRecomputeTime(time.Hour*100))
+	if _, ok := lru.get("a"); ok {
+		t.Error("XFetch. Test 4. Should expire early.")
+	}
+
+	// Far from expiring
+	lru.set("b", "bbb", time.Hour, WithRecomputeTime(time.Millisecond))
+	lru.set("c", "ccc", time.Second*10)
+	for i := 0; i < 100; i++ {
+		if _, ok := lru.get("b"); !ok {
+			t.Error("XFetch. Test 5. Should not expire early.")
+		}
+		if _, ok := lru.get("c"); !ok {
+			t.Error("XFetch. Test 6. Element without recompute time should not expire early.")
+		}
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.ttlJitter = 0.5
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		lru.set(strconv.Itoa(i), "a", time.Second*10)
+	}
+	lru.setSliding("s", "a", time.Second*10, 0)
+
+	distinct := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		validTill := lru.keys[strconv.Itoa(i)].validTill
+		if validTill.Before(now.Add(time.Second*5)) || validTill.After(time.Now().Add(time.Second*10)) {
+			t.Error("TTL Jitter. Test 1. Expiration out of range.")
+		}
+		distinct[validTill] = true
+	}
+	if len(distinct) < 50 {
+		t.Error("TTL Jitter. Test 2. Expirations should be spread.")
+	}
+	if lru.keys["s"].validTill.Before(now.Add(time.Second * 10)) {
+		t.Error("TTL Jitter. Test 3. Sliding expiration should not change.")
+	}
+}
+
 /*
 
 	Concurrent Tests
@@ -0,0 +1,65 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LookupResult Outcome of a Lookup
+type LookupResult int
+
+// Lookup results
+const (
+	// LookupUnknown The key is not on the cache
+	LookupUnknown LookupResult = iota
+	// LookupHit The key is on the cache
+	LookupHit
+	// LookupMissing The key was recorded as missing with SetMissing
+	LookupMissing
+)
+
+// SetMissing Record a key as known to be missing (negative caching)
+//
+// A tombstone with no payload is stored for the key. Get, Has and every other
+// read treat it as absent, Lookup reports it as LookupMissing so that the source
+// of the data does not need to be asked again. Tombstones are size accounted,
+// expire and are evicted like any other element, and are replaced by a Set.
+//
+// @param key element key
+//
+// @param expires Time.Duration ie: For how much time should it be known as missing
+//
+// @param opts optional settings
+func (ds *Dscache) SetMissing(key string, expires time.Duration, opts ...SetOption) error {
+	Bucket := ds.getBucketNumber(key)
+	atomic.AddUint64(&ds.numSets, 1)
+	return ds.buckets[Bucket].setMissing(key, expires, opts...)
+}
+
+// Lookup Get an element telling apart keys known to be missing from unknown ones
+//
+// Returns the payload and LookupHit if the element is on the cache, LookupMissing
+// if it was recorded with SetMissing and LookupUnknown otherwise.
+//
+// @param key element key
+func (ds *Dscache) Lookup(key string) (string, LookupResult) {
+	Bucket := ds.getBucketNumber(key)
+	payload, result, _ := ds.buckets[Bucket].find(key)
+	switch result {
+	case LookupHit:
+		atomic.AddUint64(&ds.numGets, 1)
+	case LookupMissing:
+		atomic.AddUint64(&ds.numMissingHits, 1)
+	}
+	atomic.AddUint64(&ds.numRequests, 1)
+	return payload, result
+}
+
+// NumMissingHits Number of Lookups answered by a tombstone
+func (ds *Dscache) NumMissingHits() uint64 {
+	return atomic.LoadUint64(&ds.numMissingHits)
+}
@@ -0,0 +1,79 @@
+package dscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetMissing(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	ds.Set("a", "aaa", time.Second*10)
+	ds.SetMissing("b", time.Second*10)
+
+	if payload, result := ds.Lookup("a"); result != LookupHit || payload != "aaa" {
+		t.Error("Set Missing. Test 1. Should be a hit.")
+	}
+	if payload, result := ds.Lookup("b"); result != LookupMissing || payload != "" {
+		t.Error("Set Missing. Test 2. Should be known missing.")
+	}
+	if _, result := ds.Lookup("c"); result != LookupUnknown {
+		t.Error("Set Missing. Test 3. Should be unknown.")
+	}
+	if ds.NumGets() != 1 || ds.NumMissingHits() != 1 || ds.NumRequests() != 3 {
+		t.Error("Set Missing. Test 4. Incorrect stats.")
+	}
+
+	// Every other read treats it as absent
+	if _, ok := ds.Get("b"); ok {
+		t.Error("Set Missing. Test 5. Get should miss.")
+	}
+	if ds.Has("b") {
+		t.Error("Set Missing. Test 6. Has should be false.")
+	}
+	if _, err := ds.Incr("b", 1); err != ErrNotFound {
+		t.Error("Set Missing. Test 7. Incr should not find it.")
+	}
+	for key := range ds.All() {
+		if key == "b" {
+			t.Error("Set Missing. Test 8. Tombstone should not be iterated.")
+		}
+	}
+
+	if ds.Touch("b", time.Hour) || ds.ExpireAt("b", time.Now().Add(time.Hour)) || ds.Persist("b") {
+		t.Error("Set Missing. Test 9. Touch, ExpireAt and Persist should not find it.")
+	}
+
+	// Add fills it
+	if err := ds.Add("b", "bbb", time.Second*10); err != nil {
+		t.Error("Set Missing. Test 10. Add should replace the tombstone.")
+	}
+	if payload, result := ds.Lookup("b"); result != LookupHit || payload != "bbb" {
+		t.Error("Set Missing. Test 11. Should be a hit.")
+	}
+}
+
+func TestSetMissingExpiration(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+
+	ds.SetMissing("a", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	if _, result := ds.Lookup("a"); result != LookupUnknown {
+		t.Error("Set Missing Expiration. Tombstone should expire.")
+	}
+}
+
+func TestSetMissingSizeAndEviction(t *testing.T) {
+	var lru = newLRUCache(100000, time.Minute)
+	lru.maxItems = 2
+
+	lru.setMissing("a", time.Second*10)
+	if lru.size != lru.nodeBaseSize+1 {
+		t.Error("Set Missing Eviction. Test 1. Incorrect size.")
+	}
+	lru.set("b", "bbb", time.Second*10)
+	lru.set("c", "ccc", time.Second*10)
+	if _, ok := lru.keys["a"]; ok {
+		t.Error("Set Missing Eviction. Test 2. Tombstone should be evicted.")
+	}
+}
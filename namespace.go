@@ -0,0 +1,155 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Namespace Handle to a part of a Dscache with its own keys, quota and statistics
+//
+// Keys are stored on the Dscache prefixed by the name of the namespace and ":".
+type Namespace struct {
+	ds     *Dscache
+	name   string
+	prefix string
+
+	// Quota in bytes in total and for each bucket, 0 for no quota
+	quota       uint64
+	bucketQuota uint64
+
+	size         uint64
+	numObjects   uint64
+	numGets      uint64
+	numRequests  uint64
+	numSets      uint64
+	numEvictions uint64
+}
+
+// Namespace Get the namespace with a name, creating it if needed
+//
+// Elements of the namespace can use up to quota bytes of the cache, when a set goes
+// over it the least recently used elements of the namespace are evicted, leaving the
+// elements of other namespaces alone. Like maxsize the quota is split between buckets.
+// If the namespace already exists it is returned with the quota it was created with.
+//
+// @param name namespace name
+//
+// @param quota Maxsize of the namespace in Bytes, 0 for no limit other than the cache maxsize
+func (ds *Dscache) Namespace(name string, quota uint64) *Namespace {
+	ds.nsMu.Lock()
+	defer ds.nsMu.Unlock()
+
+	if ns, ok := ds.namespaces[name]; ok {
+		return ns
+	}
+	if ds.namespaces == nil {
+		ds.namespaces = make(map[string]*Namespace)
+	}
+
+	ns := new(Namespace)
+	ns.ds = ds
+	ns.name = name
+	ns.prefix = name + ":"
+	ns.quota = quota
+	ns.bucketQuota = quota / uint64(len(ds.buckets))
+	if quota > 0 && ns.bucketQuota == 0 {
+		ns.bucketQuota = 1
+	}
+	ds.namespaces[name] = ns
+	return ns
+}
+
+// Name Name of the namespace
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Set element
+//
+// @param key element key, without the namespace prefix
+//
+// @param payload element payload
+//
+// @param expires Time.Duration ie: For how much time should it be valid
+//
+// @param opts optional settings
+func (ns *Namespace) Set(key, payload string, expires time.Duration, opts ...SetOption) error {
+	key = ns.prefix + key
+	Bucket := ns.ds.getBucketNumber(key)
+	atomic.AddUint64(&ns.numSets, 1)
+	atomic.AddUint64(&ns.ds.numSets, 1)
+	return ns.ds.buckets[Bucket].write(key, payload, applySetOptions(&setting{expires: expires, ns: ns}, opts))
+}
+
+// Get element
+//
+// @param key element key, without the namespace prefix
+func (ns *Namespace) Get(key string) (string, bool) {
+	payload, ok := ns.ds.Get(ns.prefix + key)
+	if ok {
+		atomic.AddUint64(&ns.numGets, 1)
+	}
+	atomic.AddUint64(&ns.numRequests, 1)
+	return payload, ok
+}
+
+// Purge (delete) element
+//
+// @param key element key, without the namespace prefix
+func (ns *Namespace) Purge(key string) bool {
+	return ns.ds.Purge(ns.prefix + key)
+}
+
+// Flush Purge (delete) all elements of the namespace
+//
+// Returns the number of elements purged.
+func (ns *Namespace) Flush() int {
+	// Elements of namespaces are not demoted to the L2
+	return ns.ds.purgeWhere(func(n *node) bool {
+		return n.ns == ns
+	}, nil)
+}
+
+// Quota Maxsize of the namespace in Bytes
+func (ns *Namespace) Quota() uint64 {
+	return ns.quota
+}
+
+// Size Bytes used by the elements of the namespace
+func (ns *Namespace) Size() uint64 {
+	return atomic.LoadUint64(&ns.size)
+}
+
+// NumObjects Number of Objects of the namespace in Cache
+func (ns *Namespace) NumObjects() uint64 {
+	return atomic.LoadUint64(&ns.numObjects)
+}
+
+// NumGets Number of Gets the namespace has had
+func (ns *Namespace) NumGets() uint64 {
+	return atomic.LoadUint64(&ns.numGets)
+}
+
+// NumRequests Number of Requests the namespace has had
+func (ns *Namespace) NumRequests() uint64 {
+	return atomic.LoadUint64(&ns.numRequests)
+}
+
+// NumSets Number of Sets the namespace has had
+func (ns *Namespace) NumSets() uint64 {
+	return atomic.LoadUint64(&ns.numSets)
+}
+
+// NumEvictions Number of Evictions of elements of the namespace
+func (ns *Namespace) NumEvictions() uint64 {
+	return atomic.LoadUint64(&ns.numEvictions)
+}
+
+// HitRate Gets/Tries of the namespace
+func (ns *Namespace) HitRate() float64 {
+	return float64(ns.NumGets()) / float64(ns.NumRequests())
+}
@@ -0,0 +1,121 @@
+package dscache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+	search := ds.Namespace("search", 0)
+
+	search.Set("a", "aaa", time.Second*10)
+	ds.Set("a", "other", time.Second*10)
+
+	if tmp, _ := search.Get("a"); tmp != "aaa" {
+		t.Error("Namespace. Test 1. Incorrect payload.")
+	}
+	if tmp, _ := ds.Get("search:a"); tmp != "aaa" {
+		t.Error("Namespace. Test 2. Key not prefixed.")
+	}
+	if ds.Namespace("search", 100) != search {
+		t.Error("Namespace. Test 3. Namespace not reused.")
+	}
+
+	search.Get("b")
+	if search.NumRequests() != 2 || search.NumGets() != 1 || search.NumSets() != 1 || search.NumObjects() != 1 {
+		t.Error("Namespace. Test 4. Incorrect stats.")
+	}
+
+	search.Purge("a")
+	if search.NumObjects() != 0 || search.Size() != 0 {
+		t.Error("Namespace. Test 5. Incorrect stats after purge.")
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	var getBucketNumber = func(key string) uint32 {
+		return 0
+	}
+	ds, _ := Custom(1*MB, 1, 0, 0, getBucketNumber)
+	nodeSize := ds.buckets[0].calculateBaseNodeSize()
+
+	// Room for 4 elements of the namespace
+	bulk := ds.Namespace("bulk", (nodeSize+10)*4)
+
+	ds.Set("hot", "abc", time.Second*10)
+	for i := 0; i < 10; i++ {
+		bulk.Set(strconv.Itoa(i), "abc", time.Second*10) // 5 + 3 + 1 + 1
+	}
+
+	if bulk.NumObjects() != 4 || bulk.Size() > bulk.Quota() {
+		t.Error("Namespace Quota. Quota not enforced: ", bulk.NumObjects(), bulk.Size())
+	}
+	if _, ok := bulk.Get("9"); !ok {
+		t.Error("Namespace Quota. Last element evicted.")
+	}
+	if _, ok := bulk.Get("0"); ok {
+		t.Error("Namespace Quota. Least recently used element not evicted.")
+	}
+	if _, ok := ds.Get("hot"); !ok {
+		t.Error("Namespace Quota. Element outside of namespace evicted.")
+	}
+	if bulk.NumEvictions() != 6 {
+		t.Error("Namespace Quota. Incorrect evictions.")
+	}
+}
+
+func TestNamespaceQuotaNoEviction(t *testing.T) {
+	var getBucketNumber = func(key string) uint32 {
+		return 0
+	}
+	ds, _ := Custom(1*MB, 1, 0, time.Minute, getBucketNumber, WithNoEviction())
+	nodeSize := ds.buckets[0].calculateBaseNodeSize()
+
+	// Room for 4 elements of the namespace
+	bulk := ds.Namespace("bulk", (nodeSize+10)*4)
+
+	rejected := 0
+	for i := 0; i < 10; i++ {
+		if err := bulk.Set(strconv.Itoa(i), "abc", time.Second*10); err == ErrCacheFull {
+			rejected++
+		}
+	}
+	if rejected != 6 || ds.NumRejectedWrites() != 6 {
+		t.Error("Namespace Quota No Eviction. Test 1. Writes over the quota should be rejected: ", rejected)
+	}
+	if bulk.NumObjects() != 4 || bulk.NumEvictions() != 0 {
+		t.Error("Namespace Quota No Eviction. Test 2. Elements should not be evicted.")
+	}
+	if _, ok := bulk.Get("0"); !ok {
+		t.Error("Namespace Quota No Eviction. Test 3. First element should be kept.")
+	}
+
+	// Overwriting an existing element fits
+	if err := bulk.Set("0", "abd", time.Second*10); err != nil {
+		t.Error("Namespace Quota No Eviction. Test 4. Overwrite should be allowed.")
+	}
+}
+
+func TestNamespaceFlush(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, 0, nil)
+	a := ds.Namespace("a", 0)
+	b := ds.Namespace("b", 0)
+	for i := 0; i < 100; i++ {
+		a.Set(strconv.Itoa(i), "aaa", time.Second*10)
+		b.Set(strconv.Itoa(i), "bbb", time.Second*10)
+	}
+
+	if flushed := a.Flush(); flushed != 100 {
+		t.Error("Namespace Flush. Incorrect number of flushed elements.")
+	}
+	if a.NumObjects() != 0 || b.NumObjects() != 100 || ds.NumObjects() != 100 {
+		t.Error("Namespace Flush. Incorrect elements flushed.")
+	}
+
+	ds.Flush()
+	if b.NumObjects() != 0 || b.Size() != 0 {
+		t.Error("Namespace Flush. Dscache Flush not accounted.")
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import "time"
+
+// Option Optional configuration for New and Custom
+type Option func(*config)
+
+// config Optional configuration of a Dscache
+type config struct {
+	maxItems          int
+	noEvict           bool
+	maxPinnedFraction float64
+	gdsf              bool
+	maxItemFraction   float64
+	doorkeeperWindow  int
+	refreshWorkers    int
+	xfetchBeta        float64
+	ttlJitter         float64
+	leaseTTL          time.Duration
+	l2Path            string
+	l2MaxBytes        uint64
+	l2                *diskTier
+	aofPath           string
+	aofPolicy         FsyncPolicy
+	aofRewriteSize    uint64
+	aof               *aof
+}
+
+// WithMaxItems Limit the number of elements on the cache in addition to its size
+//
+// Like maxsize the limit is split between buckets, when a bucket goes over its
+// share the least recently used elements are evicted.
+func WithMaxItems(maxItems int) Option {
+	return func(c *config) {
+		c.maxItems = maxItems
+	}
+}
+
+// WithNoEviction Reject writes with ErrCacheFull instead of evicting elements
+//
+// Namespace quotas are enforced the same way. Expired elements are still
+// reclaimed to make room. Meant for caches used as bounded stores where losing
+// an element is not acceptable.
+func WithNoEviction() Option {
+	return func(c *config) {
+		c.noEvict = true
+	}
+}
+
+// WithMaxPinnedFraction Fraction of maxsize that pinned elements can take, 0.5 by default
+//
+// SetPinned returns ErrPinLimit when it would go over it, so a bucket can't be
+// fully pinned. It must be lower than 1, otherwise the default is used.
+func WithMaxPinnedFraction(fraction float64) Option {
+	return func(c *config) {
+		c.maxPinnedFraction = fraction
+	}
+}
+
+// WithGDSF Evict by GreedyDual-Size-Frequency instead of LRU
+//
+// Elements with a low cost (see WithCost) and few requests per byte are
+// evicted first. Priorities and pinned elements are still respected.
+func WithGDSF() Option {
+	return func(c *config) {
+		c.gdsf = true
+	}
+}
+
+// WithMaxItemFraction Reject elements bigger than a fraction of their bucket with ErrNotAdmitted
+//
+// Without it an element can take up to the whole bucket, evicting everything else.
+func WithMaxItemFraction(fraction float64) Option {
+	return func(c *config) {
+		c.maxItemFraction = fraction
+	}
+}
+
+// WithDoorkeeper Admit new keys only the second time they are set within a window
+//
+// The first set of a key is rejected with ErrNotAdmitted and remembered on a
+// Bloom filter that is cleared after window keys, so that keys requested only
+// once don't evict others. Overwrites and pinned elements are always admitted,
+// and so are sets with the WithoutDoorkeeper option, SetMulti and Compute take
+// it too.
+func WithDoorkeeper(window int) Option {
+	return func(c *config) {
+		c.doorkeeperWindow = window
+	}
+}
+
+// WithRefreshWorkers Number of goroutines refreshing stale elements for GetOrLoad, default 4
+func WithRefreshWorkers(n int) Option {
+	return func(c *config) {
+		c.refreshWorkers = n
+	}
+}
+
+// WithXFetch Probabilistic early expiration to prevent stampedes
+//
+// A get of an element nearing its expiration may miss before it expires, so that
+// one caller recomputes it while the others still get it. The probability increases
+// as the expiration approaches, with the recompute time of the element (see
+// WithRecomputeTime) and with beta, 1 is a good default, bigger values recompute
+// earlier. Only one get misses per set, elements without a recompute time never do.
+func WithXFetch(beta float64) Option {
+	return func(c *config) {
+		c.xfetchBeta = beta
+	}
+}
+
+// WithTTLJitter Take up to a fraction of the expiration away at random on every set
+//
+// Spreads the expiration of elements set at the same time with the same expiration.
+// Elements never live longer than asked. Sliding expirations are not changed.
+func WithTTLJitter(fraction float64) Option {
+	return func(c *config) {
+		c.ttlJitter = fraction
+	}
+}
+
+// WithLeaseTTL How long leases given by GetWithLease and their stale data last, default 10 seconds
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.leaseTTL = ttl
+	}
+}
+
+// WithL2 Demote evicted elements to a log file on disk instead of dropping them
+//
+// Gets that miss look for the element on the file and move it back to the cache.
+// The live elements on the file take at most maxBytes, 0 for no limit, older ones
+// are dropped. An existing file is reused, so elements survive restarts. Call
+// Close when done with the cache.
+//
+// The file is written in the background. Only the payload and expiration are
+// kept on disk, elements with tags or a namespace are not demoted.
+func WithL2(path string, maxBytes uint64) Option {
+	return func(c *config) {
+		c.l2Path = path
+		c.l2MaxBytes = maxBytes
+	}
+}
+
+// WithAOF Record writes to an append-only file and replay it when the cache is created
+//
+// Sets, purges, changes of expiration and flushes are recorded, the policy sets
+// when they are synced to disk. The file is rewritten in the background from the
+// elements on the cache when it grows beyond rewriteSize, 0 for 64 MB, and to
+// twice the size it had after the last rewrite. Call Close when done with the cache.
+//
+// Only the payload and expiration are recorded, tags, namespaces, priorities
+// and pins are not.
+func WithAOF(path string, policy FsyncPolicy, rewriteSize uint64) Option {
+	return func(c *config) {
+		c.aofPath = path
+		c.aofPolicy = policy
+		c.aofRewriteSize = rewriteSize
+	}
+}
+
+// newConfig Apply options to the default configuration
+func newConfig(opts []Option) *config {
+	c := new(config)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// open Open the files of the configuration
+func (c *config) open() error {
+	if c.l2Path != "" {
+		l2, err := openDiskTier(c.l2Path, int64(c.l2MaxBytes))
+		if err != nil {
+			return err
+		}
+		c.l2 = l2
+	}
+	if c.aofPath != "" {
+		a, err := openAOF(c.aofPath, c.aofPolicy, int64(c.aofRewriteSize))
+		if err != nil {
+			if c.l2 != nil {
+				c.l2.close()
+			}
+			return err
+		}
+		c.aof = a
+	}
+	return nil
+}
+
+// configure Apply the configuration to a bucket
+func (c *config) configure(lru *lrucache, numberOfBuckets int) {
+	lru.l2 = c.l2
+	lru.noEvict = c.noEvict
+	lru.gdsf = c.gdsf
+	lru.xfetchBeta = c.xfetchBeta
+	if c.leaseTTL > 0 {
+		lru.leaseTTL = c.leaseTTL
+	}
+	if c.ttlJitter > 0 && c.ttlJitter < 1 {
+		lru.ttlJitter = c.ttlJitter
+	}
+	if c.maxItemFraction > 0 && c.maxItemFraction < 1 {
+		lru.maxItemSize = uint64(float64(lru.maxsize) * c.maxItemFraction)
+	}
+	if c.doorkeeperWindow > 0 {
+		window := c.doorkeeperWindow / numberOfBuckets
+		if window == 0 {
+			window = 1
+		}
+		lru.doorkeeper = newDoorkeeper(window)
+	}
+	if c.maxPinnedFraction > 0 && c.maxPinnedFraction < 1 {
+		lru.maxPinned = uint64(float64(lru.maxsize) * c.maxPinnedFraction)
+	}
+	if c.maxItems > 0 {
+		lru.maxItems = c.maxItems / numberOfBuckets
+		if lru.maxItems == 0 {
+			lru.maxItems = 1
+		}
+	}
+}
+
+// SetOption Optional setting for an element being set
+type SetOption func(*setting)
+
+// WithTags Tag the element so it can be purged with every other element with the same tag
+//
+// Tags count towards the size of the element.
+func WithTags(tags ...string) SetOption {
+	return func(s *setting) {
+		s.tags = tags
+	}
+}
+
+// WithPriority Set the eviction priority of the element, PriorityNormal by default
+func WithPriority(p Priority) SetOption {
+	return func(s *setting) {
+		if p.valid() {
+			s.priority, s.hasPriority = p, true
+		}
+	}
+}
+
+// WithCost Cost of recomputing the element, used by the GDSF policy
+//
+// Any unit will do as long as it is the same for every element, ie: milliseconds.
+// Default 1.
+func WithCost(cost float64) SetOption {
+	return func(s *setting) {
+		s.cost = cost
+	}
+}
+
+// WithSoftTTL Time after which the element is stale
+//
+// GetOrLoad still returns stale elements but refreshes them in the background.
+// It should be shorter than the expiration, which is when the element is gone.
+func WithSoftTTL(soft time.Duration) SetOption {
+	return func(s *setting) {
+		s.soft = soft
+	}
+}
+
+// WithoutDoorkeeper Admit the element even if it is new to the doorkeeper
+//
+// For elements known to be requested again, ie: just written by the user.
+func WithoutDoorkeeper() SetOption {
+	return func(s *setting) {
+		s.admit = true
+	}
+}
+
+// WithRecomputeTime Time it takes to recompute the element, used by WithXFetch
+//
+// GetOrLoad records the time its loader takes.
+func WithRecomputeTime(d time.Duration) SetOption {
+	return func(s *setting) {
+		s.recompute = d
+	}
+}
+
+// applySetOptions Apply options to a setting
+//
+// Options are applied to a copy, so that writes without them don't allocate.
+func applySetOptions(s *setting, opts []SetOption) *setting {
+	if len(opts) == 0 {
+		return s
+	}
+	c := *s
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
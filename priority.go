@@ -0,0 +1,79 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import "sync/atomic"
+
+// Priority Eviction class of an element
+//
+// Each bucket keeps a LRU list per priority, when it has to make room it
+// evicts the least recently used element of the lowest priority first.
+type Priority int
+
+// Priorities, from the first to be evicted to the last
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	numPriorities
+)
+
+// defaultPriority Priority of elements set without WithPriority
+const defaultPriority = PriorityNormal
+
+// valid Whether p is one of the priorities
+func (p Priority) valid() bool {
+	return p >= 0 && p < numPriorities
+}
+
+// PrioritySize Size in bytes of the elements of a priority
+//
+// 0 for values that are not a priority, the same goes for the other priority stats.
+func (ds *Dscache) PrioritySize(p Priority) uint64 {
+	if !p.valid() {
+		return 0
+	}
+	size := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		ds.buckets[i].mu.Lock()
+		size += ds.buckets[i].prioritySizes[p]
+		ds.buckets[i].mu.Unlock()
+	}
+	return size
+}
+
+// PriorityNumGets Number of successful gets of elements of a priority
+func (ds *Dscache) PriorityNumGets(p Priority) uint64 {
+	if !p.valid() {
+		return 0
+	}
+	numGets := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numGets += atomic.LoadUint64(&ds.buckets[i].priorityHits[p])
+	}
+	return numGets
+}
+
+// PriorityNumEvictions Number of elements of a priority evicted to make room
+func (ds *Dscache) PriorityNumEvictions(p Priority) uint64 {
+	if !p.valid() {
+		return 0
+	}
+	numEvictions := uint64(0)
+	for i := 0; i < len(ds.buckets); i++ {
+		numEvictions += atomic.LoadUint64(&ds.buckets[i].priorityEvictions[p])
+	}
+	return numEvictions
+}
+
+// PriorityHitRate Gets of elements of a priority/Tries
+//
+// A miss has no priority, so the hit rates of all priorities add up to HitRate.
+func (ds *Dscache) PriorityHitRate(p Priority) float64 {
+	if !p.valid() {
+		return 0
+	}
+	return float64(ds.PriorityNumGets(p)) / float64(ds.NumRequests())
+}
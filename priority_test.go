@@ -0,0 +1,87 @@
+package dscache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPriorityEvictionOrder(t *testing.T) {
+	ds, _ := Custom(316368, 1, 0, time.Minute, nil, WithMaxItems(6))
+
+	ds.Set("high1", "a", time.Second*10, WithPriority(PriorityHigh))
+	ds.Set("high2", "a", time.Second*10, WithPriority(PriorityHigh))
+	ds.Set("normal1", "a", time.Second*10)
+	ds.Set("normal2", "a", time.Second*10)
+	ds.Set("low1", "a", time.Second*10, WithPriority(PriorityLow))
+	ds.Set("low2", "a", time.Second*10, WithPriority(PriorityLow))
+
+	// Low elements go first even if they are the most recently used
+	ds.Set("normal3", "a", time.Second*10)
+	ds.Set("normal4", "a", time.Second*10)
+	if ds.Has("low1") || ds.Has("low2") || !ds.Has("normal1") {
+		t.Error("Priority. Test 1. Low priority elements should be evicted first.")
+	}
+
+	// Then the least recently used of normal
+	ds.Get("normal1")
+	ds.Set("normal5", "a", time.Second*10)
+	if ds.Has("normal2") || !ds.Has("normal1") || !ds.Has("high1") || !ds.Has("high2") {
+		t.Error("Priority. Test 2. Least recently used normal element should be evicted.")
+	}
+	if ds.PriorityNumEvictions(PriorityLow) != 2 || ds.PriorityNumEvictions(PriorityNormal) != 1 || ds.PriorityNumEvictions(PriorityHigh) != 0 {
+		t.Error("Priority. Test 3. Incorrect evictions.")
+	}
+
+	// Overwriting changes the priority
+	ds.Set("high1", "a", time.Second*10, WithPriority(PriorityLow))
+	ds.Set("normal6", "a", time.Second*10)
+	if ds.Has("high1") || !ds.Has("high2") {
+		t.Error("Priority. Test 4. Element should have moved to the low priority.")
+	}
+	if err := ds.buckets[0].verifyEndAndStart(); err != nil {
+		t.Error("Priority. Test 5. ", err)
+	}
+
+	// Priorities compare in eviction order
+	if !(PriorityLow < PriorityNormal && PriorityNormal < PriorityHigh) {
+		t.Error("Priority. Test 6. Priorities should be ordered from low to high.")
+	}
+}
+
+func TestPriorityStats(t *testing.T) {
+	ds, _ := Custom(316368, 4, 0, time.Minute, nil)
+
+	for i := 0; i < 10; i++ {
+		ds.Set("hi"+strconv.Itoa(i), "a", time.Second*10, WithPriority(PriorityHigh))
+		ds.Set("lo"+strconv.Itoa(i), "a", time.Second*10, WithPriority(PriorityLow))
+	}
+	for i := 0; i < 10; i++ {
+		ds.Get("hi" + strconv.Itoa(i))
+	}
+	ds.Get("lo0")
+	ds.Get("missing")
+
+	if ds.PrioritySize(PriorityHigh) != ds.PrioritySize(PriorityLow) || ds.PrioritySize(PriorityNormal) != 0 {
+		t.Error("Priority Stats. Test 1. Incorrect sizes.")
+	}
+	if ds.PriorityNumGets(PriorityHigh) != 10 || ds.PriorityNumGets(PriorityLow) != 1 {
+		t.Error("Priority Stats. Test 2. Incorrect gets.")
+	}
+	if ds.PriorityHitRate(PriorityHigh) != 10.0/12 || ds.PriorityHitRate(PriorityLow) != 1.0/12 {
+		t.Error("Priority Stats. Test 3. Incorrect hit rates.")
+	}
+
+	ds.Purge("lo0")
+	ds.Flush()
+	if ds.PrioritySize(PriorityHigh) != 0 || ds.PrioritySize(PriorityLow) != 0 {
+		t.Error("Priority Stats. Test 4. Sizes should be 0 after Flush.")
+	}
+
+	// Values that are not a priority
+	for _, p := range []Priority{-1, numPriorities} {
+		if ds.PrioritySize(p) != 0 || ds.PriorityNumGets(p) != 0 || ds.PriorityNumEvictions(p) != 0 || ds.PriorityHitRate(p) != 0 {
+			t.Error("Priority Stats. Test 5. Stats of an invalid priority should be 0.")
+		}
+	}
+}
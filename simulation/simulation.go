@@ -39,10 +39,20 @@ package main
 		-expires int
 			Expire for sets in Seconds. Default 3600 (1 Hour)
 
+		-policy string
+			Eviction policy, lru or gdsf. Default lru.
+				With gdsf the cost of each element is its payload size, as if
+				regenerating it took time proportional to its size.
+
 	Example:
 
 		go run simulation.go -keySize 100000  -dsMaxSize 0.4 -dsLists 4 -dsWorkerSleep 0.5 -expires 1 -verify true
 
+		Compare the byte hit rate of both policies:
+
+		go run simulation.go -keySize 400000 -dsMaxSize 1 -policy lru
+		go run simulation.go -keySize 400000 -dsMaxSize 1 -policy gdsf
+
 */
 
 import (
@@ -53,6 +63,7 @@ import (
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -62,6 +73,9 @@ import (
 // Create a constant string with 10000 chars
 var tenThousandChars = strings.Repeat("0123456789", 1000)
 
+// Bytes of payloads requested and of those that were found on the cache
+var requestedBytes, hitBytes uint64
+
 func main() {
 
 	verify := flag.Bool("verify", false, "Wether to run on Verify or Simulation Mode.")
@@ -72,11 +86,17 @@ func main() {
 	dsWorkerSleep := flag.Float64("dsWorkerSleep", 0.5, "ds Worker Sleep, in Seconds, may take floats.")
 	numGoRoutines := flag.Int("numGoRoutines", 64, "Number of Goroutines to be accessing the cache simultaneously.")
 	expires := flag.Int("expires", 3600, "Expire for sets in Seconds.")
+	policy := flag.String("policy", "lru", "Eviction policy, lru or gdsf.")
 	flag.Parse()
 
-	printConf(*verify, *keySize, *dsMaxSize, *dsLists, *dsGCSleep, *dsWorkerSleep, *numGoRoutines, *expires)
+	printConf(*verify, *keySize, *dsMaxSize, *dsLists, *dsGCSleep, *dsWorkerSleep, *numGoRoutines, *expires, *policy)
+
+	var opts []dscache.Option
+	if *policy == "gdsf" {
+		opts = append(opts, dscache.WithGDSF())
+	}
 
-	ds, _ := dscache.Custom(uint64(*dsMaxSize*float64(dscache.GB)), *dsLists, time.Duration(float64(time.Second)**dsGCSleep), time.Duration(float64(time.Second)**dsWorkerSleep), nil)
+	ds, _ := dscache.Custom(uint64(*dsMaxSize*float64(dscache.GB)), *dsLists, time.Duration(float64(time.Second)**dsGCSleep), time.Duration(float64(time.Second)**dsWorkerSleep), nil, opts...)
 
 	keyArr := generateKeys()
 
@@ -94,7 +114,7 @@ func main() {
 	go func() {
 		<-c
 		printExit(i, &memStats, ds)
-		printConf(*verify, *keySize, *dsMaxSize, *dsLists, *dsGCSleep, *dsWorkerSleep, *numGoRoutines, *expires)
+		printConf(*verify, *keySize, *dsMaxSize, *dsLists, *dsGCSleep, *dsWorkerSleep, *numGoRoutines, *expires, *policy)
 		os.Exit(1)
 	}()
 
@@ -134,13 +154,18 @@ func generateKeys() [7311616]string {
 
 // If Key is present get it
 // If it's not set it with a string of 5000 to 10001 characters
+//
+// Payload sizes are the same for a key on every set, so that the bytes
+// requested don't depend on what was on the cache.
 func getSet(ds *dscache.Dscache, key string, expires time.Duration) {
-	_, ok := ds.Get(key)
-	if !ok {
-		rand.Seed(time.Now().UnixNano())
-		randomLength := rand.Intn(5000) + 4999
+	randomLength := 4999 + (int(key[0])+int(key[1])*7+int(key[2])*13+int(key[3])*17)*37%5000
+	atomic.AddUint64(&requestedBytes, uint64(randomLength+2))
+	payload, ok := ds.Get(key)
+	if ok {
+		atomic.AddUint64(&hitBytes, uint64(len(payload)))
+	} else {
 		str := tenThousandChars[0:randomLength] + "  "
-		ds.Set(key, str, expires)
+		ds.Set(key, str, expires, dscache.WithCost(float64(len(str))))
 	}
 }
 
@@ -154,7 +179,7 @@ func runOps(ds *dscache.Dscache, keySize int, keyArr *[7311616]string, expires t
 }
 
 // Print configuration
-func printConf(verify bool, keySize int, dsMaxSize float64, dsLists int, dsGCSleep float64, dsWorkerSleep float64, numGoRoutines int, expires int) {
+func printConf(verify bool, keySize int, dsMaxSize float64, dsLists int, dsGCSleep float64, dsWorkerSleep float64, numGoRoutines int, expires int, policy string) {
 	fmt.Println("--------------------------------------------")
 	fmt.Println("Verify:\t\t\t\t", verify)
 	fmt.Println("-----")
@@ -166,6 +191,7 @@ func printConf(verify bool, keySize int, dsMaxSize float64, dsLists int, dsGCSle
 	fmt.Println("ds.Lists:\t\t\t", dsLists)
 	fmt.Println("ds.GCSleep:\t\t\t", dsGCSleep)
 	fmt.Println("ds.Workersleep:\t\t\t", dsWorkerSleep)
+	fmt.Println("ds.Policy:\t\t\t", policy)
 	fmt.Println("-----")
 	fmt.Println("NumGoRoutines:\t\t\t", numGoRoutines)
 	fmt.Println("expires:\t\t\t", expires)
@@ -195,6 +221,7 @@ func printStats(memStats *runtime.MemStats, ds *dscache.Dscache) {
 	fmt.Println("ds.NumSets:\t\t", ds.NumSets())
 	fmt.Println("ds.NumRequests:\t\t", ds.NumRequests())
 	fmt.Printf("ds.HitRate:\t\t %.3f\n", ds.HitRate())
+	fmt.Printf("ByteHitRate:\t\t %.3f\n", float64(atomic.LoadUint64(&hitBytes))/float64(atomic.LoadUint64(&requestedBytes)))
 	fmt.Println("ds.NumEvictions:\t", ds.NumEvictions())
 	fmt.Println("-----")
 	fmt.Println("NextGC:\t\t", memStats.NextGC)
@@ -0,0 +1,459 @@
+// Copyright 2016 Emiliano Martínez Luque. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store Backing store of a StoreCache, ie: a key-value database
+type Store interface {
+	// Load the payload of a key, ErrNotFound if it does not exist
+	Load(key string) (string, error)
+	// Store the payload of a key
+	Store(key, payload string) error
+	// Delete a key, it is not an error if it does not exist
+	Delete(key string) error
+}
+
+// BatchStore A Store that can write various keys at once
+//
+// Used by write-behind instead of writing the keys of a batch one by one.
+type BatchStore interface {
+	Store
+	// StoreBatch Store payloads and delete keys
+	StoreBatch(payloads map[string]string, deletes []string) error
+}
+
+// ErrClosed Used when writing to a StoreCache that was closed
+var ErrClosed = errors.New("Store Cache is Closed")
+
+// WriteError Write-behind writes that could not be written to the store
+//
+// Returned by Flush, the writes are kept pending and retried, and by Close,
+// the writes are lost. Err is the last error of the store.
+type WriteError struct {
+	Keys []string
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Could Not Write %d Keys to the Store: %v", len(e.Keys), e.Err)
+}
+
+// Unwrap Error of the store
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Defaults of a StoreCache
+const (
+	defaultStoreAttempts  = 3
+	defaultStoreBackoff   = 100 * time.Millisecond
+	defaultWriteBatchSize = 100
+)
+
+// Longest wait of the write-behind worker before retrying failed writes
+const maxFlushBackoff = time.Minute
+
+// Number of locks that serialize the writes of keys, keys are spread among them
+const storeKeyLocks = 64
+
+// StoreOption Optional configuration for NewStoreCache
+type StoreOption func(*StoreCache)
+
+// WithWriteBehind Write to the store in the background instead of on every Set
+//
+// Writes are batched and flushed every interval or when batchSize keys are
+// pending, whichever happens first, 0 to flush only full batches. Repeated
+// writes of a key between flushes are coalesced, only the last one is written.
+// Writes that fail are retried after a backoff that doubles, up to a minute,
+// until they succeed, nothing is flushed meanwhile.
+func WithWriteBehind(interval time.Duration, batchSize int) StoreOption {
+	return func(sc *StoreCache) {
+		sc.writeBehind = true
+		sc.interval = interval
+		if batchSize > 0 {
+			sc.batchSize = batchSize
+		}
+	}
+}
+
+// WithRetry Attempts made to write to the store and backoff before the first retry
+//
+// The backoff doubles on every retry. Default 3 attempts and 100ms.
+func WithRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(sc *StoreCache) {
+		if attempts > 0 {
+			sc.attempts = attempts
+		}
+		sc.backoff = backoff
+	}
+}
+
+// pendingWrite Write-behind write waiting to be flushed
+type pendingWrite struct {
+	payload string
+	delete  bool
+}
+
+// StoreCache Dscache in front of a backing Store
+//
+// Gets read through to the store on misses. Sets and Deletes write through to
+// the store, or write behind with WithWriteBehind.
+type StoreCache struct {
+	ds      *Dscache
+	store   Store
+	expires time.Duration
+
+	attempts int
+	backoff  time.Duration
+
+	writeBehind bool
+	interval    time.Duration
+	batchSize   int
+
+	// Writes pending to be flushed, the batch being flushed and whether it was closed
+	mu       sync.Mutex
+	pending  map[string]pendingWrite
+	flushing map[string]pendingWrite
+	closed   bool
+
+	// Serializes flushes
+	flushMu sync.Mutex
+
+	// Serialize Sets and Deletes of a key, so the store and the cache apply them in the same order
+	keyMu   [storeKeyLocks]sync.Mutex
+	keyLock func(string) uint32
+
+	kick chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewStoreCache Put a Dscache in front of a Store
+//
+// Call Close when done to flush pending writes.
+//
+// @param ds cache
+//
+// @param store backing store
+//
+// @param expires Time.Duration ie: For how much time should elements be kept on the cache
+//
+// @param opts optional configuration, ie: WithWriteBehind(time.Second, 100)
+func NewStoreCache(ds *Dscache, store Store, expires time.Duration, opts ...StoreOption) *StoreCache {
+	sc := &StoreCache{
+		ds:        ds,
+		store:     store,
+		expires:   expires,
+		attempts:  defaultStoreAttempts,
+		backoff:   defaultStoreBackoff,
+		batchSize: defaultWriteBatchSize,
+		pending:   make(map[string]pendingWrite),
+		keyLock:   defaultGetBucketNumber(storeKeyLocks),
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	if sc.writeBehind {
+		sc.wg.Add(1)
+		go sc.flusher()
+	}
+	return sc
+}
+
+// Get element, loading it from the store if it is not on the cache
+//
+// Returns ErrNotFound if it is not on the store either, the key is then
+// recorded as missing on the cache (see SetMissing) until it is set. A load
+// is not cached if the key is set or deleted while it runs (see GetOrLoad).
+//
+// @param key element key
+func (sc *StoreCache) Get(key string) (string, error) {
+	return sc.ds.GetOrLoad(key, 0, sc.expires, sc.load)
+}
+
+// load Load from the store unless there is a write pending for the key
+func (sc *StoreCache) load(key string) (string, error) {
+	sc.mu.Lock()
+	w, ok := sc.pending[key]
+	if !ok {
+		w, ok = sc.flushing[key]
+	}
+	sc.mu.Unlock()
+	if ok {
+		if w.delete {
+			return "", ErrNotFound
+		}
+		return w.payload, nil
+	}
+	return sc.store.Load(key)
+}
+
+// Set element on the cache and the store
+//
+// With write-through the store is written first, if it fails the error is
+// returned and the element is purged from the cache. If the cache rejects the
+// payload (ErrMaxsize, ErrNotAdmitted, ErrCacheFull) the element is purged
+// too, so that it is loaded from the store instead of serving the old payload.
+// That is not an error of Set, the store has the payload.
+//
+// Sets and Deletes of the same key are serialized, so concurrent writes end
+// with the same payload on the store and the cache.
+//
+// @param key element key
+//
+// @param payload element payload
+func (sc *StoreCache) Set(key, payload string) error {
+	if sc.isClosed() {
+		return ErrClosed
+	}
+	mu := sc.lockKey(key)
+	defer mu.Unlock()
+	if !sc.writeBehind {
+		if err := sc.retry(func() error { return sc.store.Store(key, payload) }); err != nil {
+			sc.ds.Purge(key)
+			return err
+		}
+		sc.cache(key, payload)
+		return nil
+	}
+	if err := sc.queue(key, pendingWrite{payload: payload}); err != nil {
+		return err
+	}
+	sc.cache(key, payload)
+	return nil
+}
+
+// cache Set an element on the cache, purging it if the cache rejects it
+func (sc *StoreCache) cache(key, payload string) {
+	if err := sc.ds.Set(key, payload, sc.expires); err != nil {
+		sc.ds.Purge(key)
+	}
+}
+
+// Delete element from the store and the cache
+//
+// The store is written, or the delete queued, before the element is purged, so
+// that a Get that misses meanwhile doesn't load it back from the store. With
+// write-through the element is purged even if the store fails.
+//
+// @param key element key
+func (sc *StoreCache) Delete(key string) error {
+	if sc.isClosed() {
+		return ErrClosed
+	}
+	mu := sc.lockKey(key)
+	defer mu.Unlock()
+	if !sc.writeBehind {
+		err := sc.retry(func() error { return sc.store.Delete(key) })
+		sc.ds.Purge(key)
+		return err
+	}
+	if err := sc.queue(key, pendingWrite{delete: true}); err != nil {
+		return err
+	}
+	sc.ds.Purge(key)
+	return nil
+}
+
+// lockKey Lock the writes of a key, returns the lock to unlock
+func (sc *StoreCache) lockKey(key string) *sync.Mutex {
+	mu := &sc.keyMu[sc.keyLock(key)]
+	mu.Lock()
+	return mu
+}
+
+// isClosed Whether Close was called
+func (sc *StoreCache) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
+
+// queue Add a write-behind write, replacing any pending write of the key
+func (sc *StoreCache) queue(key string, w pendingWrite) error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return ErrClosed
+	}
+	sc.pending[key] = w
+	full := len(sc.pending) >= sc.batchSize
+	sc.mu.Unlock()
+
+	if full {
+		select {
+		case sc.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush Write the pending writes to the store now
+//
+// Writes that fail after all attempts are kept pending, unless the key was
+// written again meanwhile, and returned on a *WriteError.
+func (sc *StoreCache) Flush() error {
+	sc.flushMu.Lock()
+	defer sc.flushMu.Unlock()
+
+	sc.mu.Lock()
+	batch := sc.pending
+	sc.pending = make(map[string]pendingWrite)
+	sc.flushing = batch
+	sc.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	failed, err := sc.write(batch)
+
+	sc.mu.Lock()
+	for key, w := range failed {
+		if _, ok := sc.pending[key]; !ok {
+			sc.pending[key] = w
+		}
+	}
+	sc.flushing = nil
+	sc.mu.Unlock()
+
+	if err == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(failed))
+	for key := range failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &WriteError{keys, err}
+}
+
+// write Write a batch to the store, returns the writes that failed
+func (sc *StoreCache) write(batch map[string]pendingWrite) (map[string]pendingWrite, error) {
+	if bs, ok := sc.store.(BatchStore); ok {
+		payloads := make(map[string]string)
+		var deletes []string
+		for key, w := range batch {
+			if w.delete {
+				deletes = append(deletes, key)
+			} else {
+				payloads[key] = w.payload
+			}
+		}
+		if err := sc.retry(func() error { return bs.StoreBatch(payloads, deletes) }); err != nil {
+			return batch, err
+		}
+		return nil, nil
+	}
+
+	var failed map[string]pendingWrite
+	var lastErr error
+	for key, w := range batch {
+		err := sc.retry(func() error {
+			if w.delete {
+				return sc.store.Delete(key)
+			}
+			return sc.store.Store(key, w.payload)
+		})
+		if err != nil {
+			if failed == nil {
+				failed = make(map[string]pendingWrite)
+			}
+			failed[key] = w
+			lastErr = err
+		}
+	}
+	return failed, lastErr
+}
+
+// retry Call fn until it succeeds or the attempts run out, doubling the backoff
+func (sc *StoreCache) retry(fn func() error) error {
+	backoff := sc.backoff
+	var err error
+	for i := 0; i < sc.attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// flusher Write-behind worker, flushes every interval, when a batch is full and after a backoff when a flush fails
+//
+// Once a flush fails nothing is flushed until the backoff is over.
+func (sc *StoreCache) flusher() {
+	defer sc.wg.Done()
+
+	var ticks <-chan time.Time
+	if sc.interval > 0 {
+		ticker := time.NewTicker(sc.interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	// Ticks and full batches are ignored while waiting to retry
+	tick, kick := ticks, sc.kick
+	var retry <-chan time.Time
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-tick:
+		case <-kick:
+		case <-retry:
+		case <-sc.done:
+			return
+		}
+		retry = nil
+		tick, kick = ticks, sc.kick
+		if err := sc.Flush(); err == nil {
+			backoff = 0
+			continue
+		}
+		switch {
+		case backoff == 0 && sc.backoff > 0:
+			backoff = sc.backoff
+		case backoff == 0:
+			backoff = defaultStoreBackoff
+		case backoff < maxFlushBackoff:
+			backoff = min(backoff*2, maxFlushBackoff)
+		}
+		retry = time.After(backoff)
+		tick, kick = nil, nil
+	}
+}
+
+// Close Stop accepting writes and flush the pending ones
+//
+// Returns a *WriteError with the keys of the writes that could not be flushed,
+// those writes are lost.
+func (sc *StoreCache) Close() error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	sc.mu.Unlock()
+
+	if !sc.writeBehind {
+		return nil
+	}
+	close(sc.done)
+	sc.wg.Wait()
+	return sc.Flush()
+}
@@ -0,0 +1,448 @@
+package dscache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore In memory fake Store
+type memStore struct {
+	mu       sync.Mutex
+	data     map[string]string
+	loads    int
+	writes   int
+	failures int // Number of writes that fail before they start to succeed
+}
+
+var errStoreDown = errors.New("Store Down")
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string]string)}
+}
+
+func (m *memStore) Load(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads++
+	payload, ok := m.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return payload, nil
+}
+
+func (m *memStore) Store(key, payload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	if m.failures > 0 {
+		m.failures--
+		return errStoreDown
+	}
+	m.data[key] = payload
+	return nil
+}
+
+func (m *memStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	if m.failures > 0 {
+		m.failures--
+		return errStoreDown
+	}
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memStore) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payload, ok := m.data[key]
+	return payload, ok
+}
+
+// memBatchStore In memory fake BatchStore
+type memBatchStore struct {
+	*memStore
+	batches int
+}
+
+func (m *memBatchStore) StoreBatch(payloads map[string]string, deletes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches++
+	for key, payload := range payloads {
+		m.data[key] = payload
+	}
+	for _, key := range deletes {
+		delete(m.data, key)
+	}
+	return nil
+}
+
+// blockingStore memStore whose loads, stores or deletes, once started, wait to be released
+type blockingStore struct {
+	*memStore
+	block   string // "load", "store" or "delete"
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore(block string) *blockingStore {
+	return &blockingStore{newMemStore(), block, make(chan struct{}), make(chan struct{})}
+}
+
+func (b *blockingStore) Load(key string) (string, error) {
+	// Reads before it blocks
+	payload, err := b.memStore.Load(key)
+	if b.block == "load" {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return payload, err
+}
+
+func (b *blockingStore) Store(key, payload string) error {
+	// Writes before it blocks
+	err := b.memStore.Store(key, payload)
+	if b.block == "store" {
+		b.block = ""
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return err
+}
+
+func (b *blockingStore) Delete(key string) error {
+	if b.block == "delete" {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return b.memStore.Delete(key)
+}
+
+func TestStoreCacheReadThrough(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	store.data["a"] = "aaa"
+	sc := NewStoreCache(ds, store, time.Second*10)
+	defer sc.Close()
+
+	for i := 0; i < 3; i++ {
+		if payload, err := sc.Get("a"); err != nil || payload != "aaa" {
+			t.Error("Store Cache Read Through. Test 1. Should load from the store.")
+		}
+		if _, err := sc.Get("b"); err != ErrNotFound {
+			t.Error("Store Cache Read Through. Test 2. Should not be found.")
+		}
+	}
+	if store.loads != 2 {
+		t.Error("Store Cache Read Through. Test 3. Should load each key once: ", store.loads)
+	}
+}
+
+func TestStoreCacheWriteThrough(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	sc := NewStoreCache(ds, store, time.Second*10, WithRetry(3, time.Millisecond))
+	defer sc.Close()
+
+	if _, err := sc.Get("a"); err != ErrNotFound {
+		t.Error("Store Cache Write Through. Test 1. Should not be found.")
+	}
+	sc.Set("a", "aaa")
+	if payload, ok := store.get("a"); !ok || payload != "aaa" {
+		t.Error("Store Cache Write Through. Test 2. Should be written to the store.")
+	}
+	if payload, err := sc.Get("a"); err != nil || payload != "aaa" {
+		t.Error("Store Cache Write Through. Test 3. Should be on the cache.")
+	}
+
+	// Retries
+	store.failures = 2
+	if err := sc.Set("a", "bbb"); err != nil {
+		t.Error("Store Cache Write Through. Test 4. Should succeed after retrying.")
+	}
+	store.failures = 3
+	if err := sc.Set("a", "ccc"); err != errStoreDown {
+		t.Error("Store Cache Write Through. Test 5. Should fail after all attempts.")
+	}
+	if ds.Has("a") {
+		t.Error("Store Cache Write Through. Test 6. Failed write should be purged from the cache.")
+	}
+
+	sc.Delete("a")
+	if _, ok := store.get("a"); ok {
+		t.Error("Store Cache Write Through. Test 7. Should be deleted from the store.")
+	}
+}
+
+func TestStoreCacheWriteBehind(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	sc := NewStoreCache(ds, store, time.Second*10, WithWriteBehind(time.Hour, 100))
+
+	// Coalesced
+	for i := 0; i < 10; i++ {
+		sc.Set("a", strconv.Itoa(i))
+	}
+	sc.Set("b", "bbb")
+	sc.Delete("b")
+	if _, ok := store.get("a"); ok {
+		t.Error("Store Cache Write Behind. Test 1. Should not be written yet.")
+	}
+
+	// Pending writes are read even if evicted from the cache
+	ds.Purge("a")
+	if payload, err := sc.Get("a"); err != nil || payload != "9" {
+		t.Error("Store Cache Write Behind. Test 2. Pending write should be read.")
+	}
+	if _, err := sc.Get("b"); err != ErrNotFound {
+		t.Error("Store Cache Write Behind. Test 3. Pending delete should be read.")
+	}
+
+	if err := sc.Flush(); err != nil {
+		t.Error("Store Cache Write Behind. Test 4. ", err)
+	}
+	if payload, _ := store.get("a"); payload != "9" || store.writes != 2 {
+		t.Error("Store Cache Write Behind. Test 5. Writes should be coalesced: ", store.writes)
+	}
+
+	// Flush on close
+	sc.Set("c", "ccc")
+	sc.Close()
+	if payload, _ := store.get("c"); payload != "ccc" {
+		t.Error("Store Cache Write Behind. Test 6. Close should flush.")
+	}
+	if err := sc.Set("d", "ddd"); err != ErrClosed {
+		t.Error("Store Cache Write Behind. Test 7. Should be closed.")
+	}
+}
+
+func TestStoreCacheWriteBehindBatches(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := &memBatchStore{memStore: newMemStore()}
+	sc := NewStoreCache(ds, store, time.Second*10, WithWriteBehind(time.Hour, 10))
+	defer sc.Close()
+
+	for i := 0; i < 10; i++ {
+		sc.Set(strconv.Itoa(i), "a")
+	}
+
+	// Full batch is flushed without waiting for the interval
+	time.Sleep(time.Millisecond * 100)
+	store.mu.Lock()
+	batches, stored := store.batches, len(store.data)
+	store.mu.Unlock()
+	if batches != 1 || stored != 10 {
+		t.Error("Store Cache Write Behind Batches. Full batch should be flushed at once.")
+	}
+}
+
+func TestStoreCacheWriteBehindRetry(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	sc := NewStoreCache(ds, store, time.Second*10, WithWriteBehind(time.Hour, 100), WithRetry(2, time.Millisecond))
+
+	store.failures = 2
+	sc.Set("a", "aaa")
+	var werr *WriteError
+	if err := sc.Flush(); !errors.As(err, &werr) || !errors.Is(err, errStoreDown) || len(werr.Keys) != 1 || werr.Keys[0] != "a" {
+		t.Error("Store Cache Write Behind Retry. Test 1. Flush should fail with the key.")
+	}
+	if _, ok := store.get("a"); ok {
+		t.Error("Store Cache Write Behind Retry. Test 2. Should not be written.")
+	}
+
+	// Kept pending and written on close
+	if err := sc.Close(); err != nil {
+		t.Error("Store Cache Write Behind Retry. Test 3. ", err)
+	}
+	if payload, _ := store.get("a"); payload != "aaa" {
+		t.Error("Store Cache Write Behind Retry. Test 4. Failed write should be retried.")
+	}
+}
+
+func TestStoreCacheWriteBehindBackoff(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	sc := NewStoreCache(ds, store, time.Second*10, WithWriteBehind(0, 1), WithRetry(1, time.Millisecond))
+
+	// Retried by the worker without waiting for another batch
+	store.mu.Lock()
+	store.failures = 3
+	store.mu.Unlock()
+	sc.Set("a", "aaa")
+	time.Sleep(time.Millisecond * 200)
+	if payload, _ := store.get("a"); payload != "aaa" {
+		t.Error("Store Cache Write Behind Backoff. Test 1. Failed write should be retried on a timer.")
+	}
+
+	// Close reports the writes that are lost
+	store.mu.Lock()
+	store.failures = 1000
+	store.mu.Unlock()
+	sc.Set("b", "bbb")
+	var werr *WriteError
+	if err := sc.Close(); !errors.As(err, &werr) || !errors.Is(err, errStoreDown) || len(werr.Keys) != 1 || werr.Keys[0] != "b" {
+		t.Error("Store Cache Write Behind Backoff. Test 2. Close should return the lost keys: ", err)
+	}
+}
+
+func TestStoreCacheWriteBehindBackoffInterval(t *testing.T) {
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newMemStore()
+	store.failures = 1000
+	sc := NewStoreCache(ds, store, time.Second*10, WithWriteBehind(time.Millisecond*10, 100), WithRetry(1, time.Millisecond*200))
+
+	// Ticks during the backoff don't flush
+	sc.Set("a", "aaa")
+	time.Sleep(time.Millisecond * 500)
+	store.mu.Lock()
+	writes := store.writes
+	store.failures = 0
+	store.mu.Unlock()
+	if writes > 3 {
+		t.Error("Store Cache Write Behind Backoff Interval. Backoff should not be skipped by ticks: ", writes)
+	}
+	sc.Close()
+}
+
+func TestStoreCacheRejectedSet(t *testing.T) {
+	big := strings.Repeat("x", 6000)
+	test := func(mode string, opts ...StoreOption) {
+		ds, _ := Custom(316368, 32, 0, time.Minute, nil, WithMaxItemFraction(0.5))
+		store := newMemStore()
+		sc := NewStoreCache(ds, store, time.Minute, opts...)
+
+		sc.Set("k", "v1")
+		sc.Get("k")
+		if err := sc.Set("k", big); err != nil {
+			t.Error("Store Cache Rejected Set. "+mode+" Test 1. Store was written, should not fail: ", err)
+		}
+		if ds.Has("k") {
+			t.Error("Store Cache Rejected Set. " + mode + " Test 2. Old payload should be purged from the cache.")
+		}
+		if payload, err := sc.Get("k"); err != nil || payload != big {
+			t.Error("Store Cache Rejected Set. " + mode + " Test 3. Should get the new payload.")
+		}
+		sc.Close()
+		if payload, _ := store.get("k"); payload != big {
+			t.Error("Store Cache Rejected Set. " + mode + " Test 4. Should be written to the store.")
+		}
+	}
+	test("Write Through.")
+	test("Write Behind.", WithWriteBehind(time.Hour, 0))
+}
+
+func TestStoreCacheRaces(t *testing.T) {
+	// Set while a Get is loading the old payload
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newBlockingStore("load")
+	store.data["a"] = "old"
+	sc := NewStoreCache(ds, store, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		sc.Get("a")
+		close(done)
+	}()
+	<-store.started
+	store.block = ""
+	sc.Set("a", "new")
+	close(store.release)
+	<-done
+	if payload, err := sc.Get("a"); err != nil || payload != "new" {
+		t.Error("Store Cache Races. Test 1. Load should not overwrite a newer Set: ", payload)
+	}
+
+	// Delete while a Get is loading the old payload
+	ds, _ = Custom(316368, 32, 0, time.Minute, nil)
+	store = newBlockingStore("load")
+	store.data["a"] = "old"
+	sc = NewStoreCache(ds, store, time.Minute)
+
+	done = make(chan struct{})
+	go func() {
+		sc.Get("a")
+		close(done)
+	}()
+	<-store.started
+	store.block = ""
+	sc.Delete("a")
+	close(store.release)
+	<-done
+	if _, err := sc.Get("a"); err != ErrNotFound {
+		t.Error("Store Cache Races. Test 2. Load should not bring back a deleted element.")
+	}
+
+	// Get while a Delete is writing to the store
+	ds, _ = Custom(316368, 32, 0, time.Minute, nil)
+	store = newBlockingStore("delete")
+	sc = NewStoreCache(ds, store, time.Minute)
+	sc.Set("a", "old")
+
+	done = make(chan struct{})
+	go func() {
+		sc.Delete("a")
+		close(done)
+	}()
+	<-store.started
+	sc.Get("a")
+	close(store.release)
+	<-done
+	if _, err := sc.Get("a"); err != ErrNotFound {
+		t.Error("Store Cache Races. Test 3. Get during a Delete should not bring it back.")
+	}
+}
+
+func TestStoreCacheConcurrentSets(t *testing.T) {
+	// Second Set while the first one is writing to the store
+	ds, _ := Custom(316368, 32, 0, time.Minute, nil)
+	store := newBlockingStore("store")
+	sc := NewStoreCache(ds, store, time.Minute)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		sc.Set("k", "old")
+		wg.Done()
+	}()
+	<-store.started
+	go func() {
+		sc.Set("k", "new")
+		wg.Done()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+	stored, _ := store.get("k")
+	if cached, ok := ds.Get("k"); !ok || cached != stored {
+		t.Error("Store Cache Concurrent Sets. Test 1. Cache should have the payload of the store: ", cached, stored)
+	}
+
+	// Concurrent Sets with write-behind
+	ds, _ = Custom(316368, 32, 0, time.Minute, nil)
+	mem := newMemStore()
+	sc = NewStoreCache(ds, mem, time.Minute, WithWriteBehind(time.Hour, 0))
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sc.Set("k", strconv.Itoa(i*100+j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	sc.Close()
+	stored, _ = mem.get("k")
+	if cached, ok := ds.Get("k"); !ok || cached != stored {
+		t.Error("Store Cache Concurrent Sets. Test 2. Cache should have the payload of the store: ", cached, stored)
+	}
+}